@@ -2,8 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/cheif/docker-volume-icloud/icloud"
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -13,9 +21,42 @@ import (
 type iCloudInode struct {
 	fs.Inode
 
-	parent *iCloudInode
-	node   *icloud.Node
-	drive  icloud.Drive
+	// Guards node and parent, which are replaced when the data is refreshed, or the node is moved
+	nodeLock sync.RWMutex
+	node     *icloud.Node
+	parent   *iCloudInode
+
+	drive    *icloud.Drive
+	options  *volumeOptions
+	usage    *storageUsageCache
+	inodes   *inodeTable
+	overlay  *metadataOverlay
+	symlinks *symlinkCache
+
+	// The number of open handles that have downloaded the contents
+	downloads int32
+	locks     lockTable
+
+	// Only used for packages exposed as directories
+	packageLock     sync.Mutex
+	packageContents *packageContents
+}
+
+// Creates the inode for the root of a mount, everything below it shares the drive and per-mount state with it
+func newRootInode(drive *icloud.Drive, node *icloud.Node, options *volumeOptions, overlay *metadataOverlay) *iCloudInode {
+	root := &iCloudInode{
+		node:     node,
+		drive:    drive,
+		options:  options,
+		usage:    &storageUsageCache{},
+		inodes:   newInodeTable(),
+		overlay:  overlay,
+		symlinks: newSymlinkCache(),
+	}
+	// The number is used as RootStableAttr when mounting, and the root is never forgotten
+	root.inodes.ino(node)
+	root.inodes.register(node.Drivewsid(), &root.Inode)
+	return root
 }
 
 // Node types must be InodeEmbedders
@@ -24,40 +65,136 @@ var _ = (fs.InodeEmbedder)((*iCloudInode)(nil))
 var _ = (fs.NodeLookuper)((*iCloudInode)(nil))
 var _ = (fs.NodeSetattrer)((*iCloudInode)(nil))
 var _ = (fs.NodeGetattrer)((*iCloudInode)(nil))
+var _ = (fs.NodeStatfser)((*iCloudInode)(nil))
 
-func (inode *iCloudInode) ResetFileSystemCacheIfStale() {
-	if len(inode.Children()) > 0 {
-		// We've got cached data, check if it has changed
-		hasChanges, _ := inode.drive.CheckIfHasNewChanges()
-		if hasChanges {
-			inode.node, _ = inode.drive.RefreshNodeData(inode.node)
-			for _, child := range inode.Children() {
-				inode.NotifyEntry(child.Path(nil))
-			}
+func (inode *iCloudInode) getNode() *icloud.Node {
+	inode.nodeLock.RLock()
+	defer inode.nodeLock.RUnlock()
+	return inode.node
+}
+
+func (inode *iCloudInode) setNode(node *icloud.Node) {
+	inode.nodeLock.Lock()
+	defer inode.nodeLock.Unlock()
+	inode.node = node
+}
+
+func (inode *iCloudInode) getParent() *iCloudInode {
+	inode.nodeLock.RLock()
+	defer inode.nodeLock.RUnlock()
+	return inode.parent
+}
+
+// Like setNode, but also sets the parent, since an inode is reused if its node has been moved to another folder remotely
+func (inode *iCloudInode) setNodeIn(parent *iCloudInode, node *icloud.Node) {
+	inode.nodeLock.Lock()
+	defer inode.nodeLock.Unlock()
+	inode.node = node
+	inode.parent = parent
+}
+
+func (inode *iCloudInode) invalidateTree(changes *icloud.Changes) {
+	if changes.IsEmpty() {
+		return
+	}
+	if inode.isPackageDir() {
+		// The parent has already refreshed the node, and its children aren't backed by iCloud nodes
+		inode.invalidatePackage()
+		return
+	}
+	inode.invalidate(changes)
+	for _, child := range inode.Children() {
+		if childInode, ok := child.Operations().(*iCloudInode); ok && child.IsDir() {
+			childInode.invalidateTree(changes)
+		}
+	}
+}
+
+// Refreshes this directory if any of its children are affected by changes, and notifies the kernel about the entries that are stale
+func (inode *iCloudInode) invalidate(changes *icloud.Changes) {
+	node := inode.getNode()
+	if !node.HasCachedChildren() || !changes.HasChangedChildren(node) {
+		// Nothing cached that could be stale
+		return
+	}
+	// With case_insensitive, the kernel knows entries by whatever name they were looked up with, so compare names like Lookup does
+	key := func(name string) string {
+		if inode.options.CaseInsensitive {
+			return icloud.FoldName(name)
+		}
+		return name
+	}
+	// The names to notify the kernel about, by key
+	names := map[string]string{}
+	changedBefore := map[string]bool{}
+	before, beforeNames := inode.entryNames(node)
+	for i, name := range beforeNames {
+		names[key(name)] = name
+		changedBefore[key(name)] = changes.HasChanged(before[i])
+	}
+
+	node, err := inode.drive.RefreshNodeData(node)
+	if err != nil {
+		log.Println("Error when refreshing:", err)
+		return
+	}
+	inode.setNode(node)
+
+	// Everything that's been removed, added or changed is stale
+	stale := map[string]bool{}
+	for name := range changedBefore {
+		stale[name] = true
+	}
+	current := map[string]*icloud.Node{}
+	after, afterNames := inode.entryNames(node)
+	for i, name := range afterNames {
+		child := after[i]
+		changed, existed := changedBefore[key(name)]
+		names[key(name)] = name
+		stale[key(name)] = !existed || changed || changes.HasChanged(child)
+		current[key(name)] = child
+	}
+
+	for name, child := range inode.Children() {
+		if !stale[key(name)] {
+			continue
+		}
+		if node := current[key(name)]; node != nil {
+			child.Operations().(*iCloudInode).setNode(node)
+		}
+		child.NotifyContent(0, 0)
+		inode.NotifyEntry(name)
+	}
+	// Also the ones the kernel might have cached as missing
+	for name, isStale := range stale {
+		if isStale {
+			inode.NotifyEntry(names[name])
 		}
 	}
+	// The size, link count and mtime of this directory are derived from its children
+	inode.NotifyContent(0, 0)
 }
 
 func (inode *iCloudInode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	children, err := inode.drive.GetChildren(inode.node)
+	if inode.isPackageDir() {
+		pkg, errno := inode.getPackageContents()
+		if errno != 0 {
+			return nil, errno
+		}
+		return pkg.lookup(ctx, &inode.Inode, inode, "", name, out)
+	}
+	dir, err := inode.drive.GetNodeData(inode.getNode())
 	if err != nil {
 		log.Println("Error:", err)
 		// TODO: Probably wrong Errno here :/
 		return nil, 1
 	}
-	for _, node := range *children {
-		if node.Filename() == name {
-			out.Mode = 0644
-			out.Size = node.Size
-			out.SetTimes(
-				nil,
-				&node.DateChanged,
-				nil,
-			)
-			return inode.generateInode(ctx, &node), 0
-		}
+	node := inode.findChild(dir, name)
+	if node == nil {
+		return nil, syscall.ENOENT
 	}
-	return nil, syscall.ENOENT
+	inode.setAttr(node, &out.Attr)
+	return inode.generateInode(ctx, node), 0
 }
 
 func (inode *iCloudInode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
@@ -66,64 +203,351 @@ func (inode *iCloudInode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse
 	if eno != 0 {
 		return eno
 	}
-	if in.Size < current.Size {
-		if file, ok := f.(*iCloudFile); ok {
-			// File should be truncated
-			_, eno = file.Write(ctx, []byte{}, int64(in.Size))
+	file, hasFile := f.(*iCloudFile)
+	if size, ok := in.GetSize(); ok {
+		if hasFile {
+			// Uploaded when the file is flushed
+			file.Lock()
+			// The handle might have writes that aren't uploaded, so current.Size isn't necessarily what it holds
+			if file.spool != nil && (file.partial || int64(size) != file.size()) || file.spool == nil && size != current.Size {
+				eno = file.truncate(int64(size))
+			}
+			file.Unlock()
+		} else if size != current.Size {
+			// e.g. truncate(1) on a path, there's nothing that will flush it later on, so upload right away
+			file = &iCloudFile{inode: inode, node: inode.getNode()}
+			file.Lock()
+			eno = file.truncate(int64(size))
+			if eno == 0 {
+				eno = file.sync()
+			}
+			file.free()
+			file.Unlock()
+		}
+		if eno != 0 {
+			return eno
+		}
+	}
+	if inode.options.Permissions {
+		eno = inode.setPermissions(ctx, in)
+		if eno != 0 {
 			return eno
 		}
 	}
+	if mtime, ok := in.GetMTime(); ok {
+		if hasFile && file.setMtime(mtime) {
+			// Will be stored in iCloud with the pending changes
+		} else {
+			// There's no way to only change the mtime in iCloud without uploading the content again
+			inode.overlay.setMtime(inode.getNode(), mtime)
+		}
+	}
+	return inode.Getattr(ctx, f, out)
+}
+
+// Stores what's changed with chmod and chown. Like on other filesystems only root can give files away, while owners can change the mode and the group to their own.
+func (inode *iCloudInode) setPermissions(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
+	var permissions overlayPermissions
+	if mode, ok := in.GetMode(); ok {
+		mode &= 07777
+		permissions.Mode = &mode
+	}
+	if uid, ok := in.GetUID(); ok {
+		permissions.Uid = &uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		permissions.Gid = &gid
+	}
+	if permissions == (overlayPermissions{}) {
+		return 0
+	}
+
+	node := inode.getNode()
+	if caller, ok := fuse.FromContext(ctx); ok && caller.Uid != 0 {
+		var current fuse.Attr
+		inode.setAttr(node, &current)
+		notOwner := caller.Uid != current.Owner.Uid
+		changesUid := permissions.Uid != nil && *permissions.Uid != current.Owner.Uid
+		changesGid := permissions.Gid != nil && *permissions.Gid != current.Owner.Gid && *permissions.Gid != caller.Gid
+		if notOwner || changesUid || changesGid {
+			return syscall.EPERM
+		}
+	}
+	inode.overlay.setPermissions(node, permissions)
 	return 0
 }
 
 func (inode *iCloudInode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	out.Mode = 0644
-	out.Size = inode.node.Size
+	inode.setAttr(inode.getNode(), &out.Attr)
+	return 0
+}
+
+func (inode *iCloudInode) setAttr(node *icloud.Node, out *fuse.Attr) {
+	out.Mode = inode.options.modeFor(node)
+	out.Owner = fuse.Owner{Uid: inode.options.Uid, Gid: inode.options.Gid}
+	if inode.options.Permissions {
+		permissions := inode.overlay.permissions(node)
+		if permissions.Mode != nil {
+			out.Mode = *permissions.Mode
+		}
+		if permissions.Uid != nil {
+			out.Owner.Uid = *permissions.Uid
+		}
+		if permissions.Gid != nil {
+			out.Owner.Gid = *permissions.Gid
+		}
+	}
+	out.Size = node.Size
+	out.Nlink = 1
+	if node.IsDir() {
+		if count, ok := node.ItemCount(); ok {
+			// Reported by some other filesystems too, and more useful than the 0 iCloud has for folders
+			out.Size = count
+		}
+		if children := node.CachedChildren(); children != nil {
+			// One for the entry in the parent, one for "." and one for ".." in each subdirectory.
+			// Otherwise it's left at 1, which tells e.g. find that the number of subdirectories isn't known.
+			out.Nlink = 2
+			for _, child := range children {
+				if inode.options.isDir(child) {
+					out.Nlink++
+				}
+			}
+		}
+	}
+	if target, isLink := inode.symlinkTarget(node); isLink {
+		// Symlinks don't have permissions of their own
+		out.Mode = 0777
+		out.Size = uint64(len(target))
+	}
+	mtime := node.LatestChange()
+	if overlayMtime, ok := inode.overlay.mtime(node); ok {
+		mtime = overlayMtime
+	}
+	// iCloud doesn't track access or status changes, so use the closest thing we have, rather than 1970
+	ctime := node.DateCreated
+	if ctime.IsZero() {
+		ctime = mtime
+	}
 	out.SetTimes(
-		nil,
-		&inode.node.DateChanged,
-		nil,
+		&mtime,
+		&mtime,
+		&ctime,
 	)
+}
+
+// Inode numbers are derived from a hash of the drivewsid, so that they're stable across lookups and remounts.
+// If two nodes hash to the same number, the one seen last gets the next free number instead.
+// Numbers are kept for as long as go-fuse keeps the inode, which it doesn't tell us about, so the table is pruned of the forgotten ones as it grows.
+type inodeTable struct {
+	sync.Mutex
+
+	byIno map[uint64]string
+	byId  map[string]*inodeEntry
+	// Incremented when pruning, entries used since are kept, since their inodes might not have been registered yet
+	generation uint64
+	// The size at which to prune next
+	limit int
+}
+
+type inodeEntry struct {
+	ino        uint64
+	inode      *fs.Inode
+	generation uint64
+}
+
+// Pruning is pointless when there are only a few
+const minInodeTableLimit = 1024
+
+func newInodeTable() *inodeTable {
+	return &inodeTable{
+		byIno: map[uint64]string{},
+		byId:  map[string]*inodeEntry{},
+		limit: minInodeTableLimit,
+	}
+}
+
+func (table *inodeTable) ino(node *icloud.Node) uint64 {
+	return table.allocate(node.Drivewsid(), node.Hash())
+}
+
+func (table *inodeTable) allocate(id string, hash uint64) uint64 {
+	table.Lock()
+	defer table.Unlock()
+	if entry, ok := table.byId[id]; ok {
+		entry.generation = table.generation
+		return entry.ino
+	}
+	ino := table.free(id, hash)
+	table.byIno[ino] = id
+	table.byId[id] = &inodeEntry{ino: ino, generation: table.generation}
+	if len(table.byId) > table.limit {
+		table.prune()
+	}
+	return ino
+}
+
+// Returns the number that id has, or would get, without keeping it, e.g. for directory listings, which don't create inodes
+func (table *inodeTable) peek(id string, hash uint64) uint64 {
+	table.Lock()
+	defer table.Unlock()
+	if entry, ok := table.byId[id]; ok {
+		return entry.ino
+	}
+	return table.free(id, hash)
+}
+
+// Must be called with the lock held
+func (table *inodeTable) free(id string, hash uint64) uint64 {
+	ino := hash
+	for {
+		// 0 means automatic, 1 is the default root and ^0 is reserved by go-fuse
+		if owner, taken := table.byIno[ino]; ino > 1 && ino != ^uint64(0) && (!taken || owner == id) {
+			return ino
+		}
+		ino++
+	}
+}
+
+// Tells which inode has the number allocated for id, so that it's kept until the inode is forgotten
+func (table *inodeTable) register(id string, inode *fs.Inode) {
+	table.Lock()
+	defer table.Unlock()
+	if entry, ok := table.byId[id]; ok {
+		entry.inode = inode
+	}
+}
+
+// Returns the inode registered for id, or nil
+func (table *inodeTable) inode(id string) *fs.Inode {
+	table.Lock()
+	defer table.Unlock()
+	if entry, ok := table.byId[id]; ok {
+		return entry.inode
+	}
+	return nil
+}
+
+// Drops the numbers of inodes that have been forgotten, or that were never created. Must be called with the lock held.
+func (table *inodeTable) prune() {
+	for id, entry := range table.byId {
+		recent := entry.generation == table.generation
+		if recent || entry.inode != nil && !entry.inode.Forgotten() {
+			continue
+		}
+		delete(table.byId, id)
+		delete(table.byIno, entry.ino)
+	}
+	table.generation++
+	table.limit = 2 * len(table.byId)
+	if table.limit < minInodeTableLimit {
+		table.limit = minInodeTableLimit
+	}
+}
+
+const storageUsageTTL = time.Minute
+
+// Storage usage is account-wide, and changes slowly, so we only fetch it every storageUsageTTL
+type storageUsageCache struct {
+	sync.Mutex
+
+	usage     *icloud.StorageUsageInfo
+	fetchedAt time.Time
+}
+
+func (cache *storageUsageCache) get(drive *icloud.Drive) (*icloud.StorageUsageInfo, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.usage == nil || time.Since(cache.fetchedAt) > storageUsageTTL {
+		usage, err := drive.GetStorageUsage()
+		if err != nil {
+			return nil, err
+		}
+		cache.usage = usage
+		cache.fetchedAt = time.Now()
+	}
+	return cache.usage, nil
+}
+
+func (inode *iCloudInode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	usage, err := inode.usage.get(inode.drive)
+	if err != nil {
+		log.Println("Error:", err)
+		return syscall.EIO
+	}
+	const blockSize = 4096
+	free := uint64(0)
+	if usage.TotalStorageInBytes > usage.UsedStorageInBytes {
+		free = usage.TotalStorageInBytes - usage.UsedStorageInBytes
+	}
+	out.Bsize = blockSize
+	out.Frsize = blockSize
+	out.Blocks = usage.TotalStorageInBytes / blockSize
+	out.Bfree = free / blockSize
+	out.Bavail = free / blockSize
+	out.NameLen = 255
 	return 0
 }
 
 func (inode *iCloudInode) generateInode(ctx context.Context, node *icloud.Node) *fs.Inode {
+	stable := inode.stableAttr(node)
+	// go-fuse would use the existing inode with the same number instead of a new one, so it's the one that needs the latest node, and parent, since it might have been moved
+	if existing := inode.inodes.inode(node.Drivewsid()); existing != nil && existing.StableAttr() == stable {
+		if existingInode, ok := existing.Operations().(*iCloudInode); ok {
+			existingInode.setNodeIn(inode, node)
+			return existing
+		}
+	}
 	newNode := inode.NewInode(
 		ctx,
 		&iCloudInode{
-			node:   node,
-			drive:  inode.drive,
-			parent: inode,
+			node:     node,
+			drive:    inode.drive,
+			parent:   inode,
+			options:  inode.options,
+			usage:    inode.usage,
+			inodes:   inode.inodes,
+			overlay:  inode.overlay,
+			symlinks: inode.symlinks,
 		},
-		stableAttr(node),
+		stable,
 	)
+	inode.inodes.register(node.Drivewsid(), newNode)
 	return newNode
 }
 
-func stableAttr(node *icloud.Node) fs.StableAttr {
-	attr := fs.StableAttr{}
-	if node.Extension == nil {
-		// TODO: This is a directory, probably a better way to test this?
-		attr.Mode = fuse.S_IFDIR
+func (inode *iCloudInode) stableAttr(node *icloud.Node) fs.StableAttr {
+	return fs.StableAttr{
+		Ino:  inode.inodes.ino(node),
+		Mode: inode.fileType(node),
 	}
-	return attr
 }
 
 var _ = (fs.NodeReaddirer)((*iCloudInode)(nil))
 
 func (inode *iCloudInode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	children, err := inode.drive.GetChildren(inode.node)
+	if inode.isPackageDir() {
+		pkg, errno := inode.getPackageContents()
+		if errno != 0 {
+			return nil, errno
+		}
+		return pkg.readdir(inode, ""), 0
+	}
+	dir, err := inode.drive.GetNodeData(inode.getNode())
 	if err != nil {
 		log.Println("Error:", err)
 		// TODO: Probably wrong Errno here :/
 		return nil, 1
 	}
-	return &iCloudDirStream{*children}, 0
+	children, names := inode.entryNames(dir)
+	return &iCloudDirStream{children, names, inode}, 0
 }
 
 // DirStream implementation
 type iCloudDirStream struct {
-	children []icloud.Node
+	children []*icloud.Node
+	names    []string
+	dir      *iCloudInode
 }
 
 func (stream *iCloudDirStream) HasNext() bool {
@@ -132,17 +556,14 @@ func (stream *iCloudDirStream) HasNext() bool {
 
 func (stream *iCloudDirStream) Next() (fuse.DirEntry, syscall.Errno) {
 	next := stream.children[0]
+	name := stream.names[0]
 	stream.children = stream.children[1:]
+	stream.names = stream.names[1:]
 	entry := fuse.DirEntry{
-		Name: next.Filename(),
-		Ino:  0,
-	}
-	if next.Extension == nil {
-		// TODO: This is a directory, probably a better way to test this?
-		entry.Mode = fuse.S_IFDIR
-	} else {
-		entry.Mode = fuse.S_IFREG
+		Name: name,
+		Ino:  stream.dir.inodes.peek(next.Drivewsid(), next.Hash()),
 	}
+	entry.Mode = stream.dir.fileType(next) | stream.dir.options.modeFor(next)
 	return entry, 0
 }
 
@@ -151,84 +572,460 @@ func (stream *iCloudDirStream) Close() {}
 // File Open/Read handling
 func (inode *iCloudInode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	file := iCloudFile{
-		inode: inode,
+		inode:     inode,
+		node:      inode.getNode(),
+		append:    flags&syscall.O_APPEND != 0,
+		writeOnly: flags&syscall.O_ACCMODE == syscall.O_WRONLY,
+	}
+	if flags&syscall.O_TRUNC != 0 && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		// The kernel usually truncates with Setattr instead, but either way there's no need to download what's thrown away
+		if errno := file.truncate(0); errno != 0 {
+			return nil, 0, errno
+		}
 	}
 	return &file, fuse.FOPEN_KEEP_CACHE, 0
 }
 
+var _ = (fs.NodeCreater)((*iCloudInode)(nil))
+
+// Creates an empty file and opens it, or opens the existing one unless O_EXCL is set
+func (inode *iCloudInode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if inode.isReadOnlyDir() {
+		return nil, nil, 0, syscall.EROFS
+	}
+	// The kernel only calls this if it doesn't know about name, but what we've listed might be out of date
+	existing, errno := inode.refreshAndFind(name)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	if existing != nil && flags&syscall.O_EXCL != 0 {
+		return nil, nil, 0, syscall.EEXIST
+	}
+	if existing == nil {
+		base, extension := icloud.SplitFilename(name)
+		err := inode.drive.CreateFile(inode.getNode(), base, extension, []byte{})
+		if err != nil {
+			log.Println("Error when creating file:", err)
+			return nil, nil, 0, syscall.EIO
+		}
+		existing, errno = inode.refreshAndFind(name)
+		if errno != 0 {
+			return nil, nil, 0, errno
+		}
+		if existing == nil {
+			log.Printf("Created %v, but it isn't listed", name)
+			return nil, nil, 0, syscall.EIO
+		}
+		if inode.options.Permissions {
+			// Like chmod, since iCloud has nowhere to store the mode
+			mode &= 07777
+			inode.overlay.setPermissions(existing, overlayPermissions{Mode: &mode})
+		}
+	}
+
+	inode.setAttr(existing, &out.Attr)
+	child := inode.generateInode(ctx, existing)
+	childInode := child.Operations().(*iCloudInode)
+	fh, fuseFlags, errno := childInode.Open(ctx, flags)
+	return child, fh, fuseFlags, errno
+}
+
+// Returns the cached children of dir, and the names to present them as, like dir.EntryNames but with packages that are exposed as zip-archives named like it
+func (inode *iCloudInode) entryNames(dir *icloud.Node) ([]*icloud.Node, []string) {
+	children, names := dir.EntryNames()
+	if inode.options.Packages != packagesAsZip {
+		return children, names
+	}
+	// The cached names are shared, so can't be modified
+	names = append([]string{}, names...)
+	for i, child := range children {
+		if child.Type == icloud.TypePackage {
+			names[i] += zipSuffix
+		}
+	}
+	return children, names
+}
+
+const zipSuffix = ".zip"
+
+// Returns the cached child of dir that's presented as name, or nil if there's none
+func (inode *iCloudInode) findChild(dir *icloud.Node, name string) *icloud.Node {
+	caseInsensitive := inode.options.CaseInsensitive
+	if inode.options.Packages == packagesAsZip {
+		if i := len(name) - len(zipSuffix); i > 0 && (name[i:] == zipSuffix || caseInsensitive && strings.EqualFold(name[i:], zipSuffix)) {
+			child := dir.FindChild(name[:i], caseInsensitive)
+			if child != nil && child.Type == icloud.TypePackage {
+				return child
+			}
+		}
+	}
+	child := dir.FindChild(name, caseInsensitive)
+	if child != nil && child.Type == icloud.TypePackage && inode.options.Packages == packagesAsZip {
+		// Only found by the name with the suffix
+		return nil
+	}
+	return child
+}
+
+// Returns true if nothing can be created in this directory, i.e. packages exposed as directories, and the folder listing all app libraries
+func (inode *iCloudInode) isReadOnlyDir() bool {
+	return inode.isPackageDir() || inode.getNode().IsVirtual()
+}
+
+// Fetches the current children of this directory, and returns the one called name, if any
+func (inode *iCloudInode) refreshAndFind(name string) (*icloud.Node, syscall.Errno) {
+	node, err := inode.drive.RefreshNodeData(inode.getNode())
+	if err != nil {
+		log.Println("Error when refreshing:", err)
+		return nil, syscall.EIO
+	}
+	inode.setNode(node)
+	return inode.findChild(node, name), 0
+}
+
 type iCloudFile struct {
+	// Guards the fields below, since the kernel can issue concurrent requests for the same handle
+	sync.Mutex
+
 	inode *iCloudInode
+	// The version of the node that data is based on, used to detect if it's been modified remotely when writing
+	node *icloud.Node
+
+	// The contents, kept in an unlinked temporary file rather than in memory, since files can be large. nil until they're needed.
+	spool *os.File
+	// How much of spool that's used
+	length int64
+	dirty  bool
+	// Set with utimes while there are changes that haven't been uploaded
+	mtime time.Time
+	// Set when spool only holds what's been written from the start of the file, and the rest hasn't been downloaded
+	partial bool
 
-	data  *[]byte
-	dirty bool
+	append    bool
+	writeOnly bool
+	// Set when the contents have been downloaded, and counted in the inode's downloads
+	downloaded bool
 }
 
 var _ = (fs.FileReader)((*iCloudFile)(nil))
 var _ = (fs.FileWriter)((*iCloudFile)(nil))
 var _ = (fs.FileFlusher)((*iCloudFile)(nil))
+var _ = (fs.FileFsyncer)((*iCloudFile)(nil))
+var _ = (fs.FileReleaser)((*iCloudFile)(nil))
 
 func (file *iCloudFile) ensureDataFetched() syscall.Errno {
-	if file.data == nil {
-		bytes, err := file.inode.drive.GetData(file.inode.node)
-		if err != nil {
-			log.Println("Error:", err)
-			// TODO: Probably wrong Errno here :/
-			return 1
+	if file.spool != nil && !file.partial {
+		return 0
+	}
+	created := file.spool == nil
+	if errno := file.openSpool(); errno != 0 {
+		return errno
+	}
+	// Keep what's been written, on top of what was there before
+	w := &spoolWriter{file: file.spool, skip: file.length}
+	err := file.inode.drive.GetDataTo(file.node, w)
+	if err != nil {
+		log.Println("Error:", err)
+		if created {
+			// Nothing has been fetched
+			file.closeSpool()
+		}
+		// TODO: Probably wrong Errno here :/
+		return 1
+	}
+	if !file.downloaded {
+		atomic.AddInt32(&file.inode.downloads, 1)
+		file.downloaded = true
+	}
+	if w.written > file.length {
+		file.length = w.written
+	}
+	file.partial = false
+	return 0
+}
+
+// Creates the file that holds the contents, if there isn't one. Must be called with the lock held.
+func (file *iCloudFile) openSpool() syscall.Errno {
+	if file.spool != nil {
+		return 0
+	}
+	spool, err := os.CreateTemp("", "icloud-")
+	if err != nil {
+		log.Println("Error when creating temporary file:", err)
+		return syscall.EIO
+	}
+	// Only kept for as long as it's open, so nothing is left behind if we crash
+	os.Remove(spool.Name())
+	file.spool = spool
+	file.length = 0
+	return 0
+}
+
+// Must be called with the lock held
+func (file *iCloudFile) closeSpool() {
+	if file.spool != nil {
+		file.spool.Close()
+		file.spool = nil
+	}
+	file.length = 0
+}
+
+// Writes what's downloaded to the spool, except for the first skip bytes, which have already been written locally
+type spoolWriter struct {
+	file    *os.File
+	skip    int64
+	written int64
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	start := w.written
+	w.written += int64(n)
+	if w.written <= w.skip {
+		return n, nil
+	}
+	if start < w.skip {
+		p = p[w.skip-start:]
+		start = w.skip
+	}
+	if _, err := w.file.WriteAt(p, start); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Sets the mtime to upload with the pending changes, returns false if there are none
+func (file *iCloudFile) setMtime(mtime time.Time) bool {
+	file.Lock()
+	defer file.Unlock()
+	if !file.dirty {
+		return false
+	}
+	file.mtime = mtime
+	return true
+}
+
+// Shrinks or extends the file to size, filling it with zeroes. Must be called with the lock held.
+func (file *iCloudFile) truncate(size int64) syscall.Errno {
+	if size == 0 {
+		// Nothing is kept, so there's no need to download it
+		if errno := file.openSpool(); errno != 0 {
+			return errno
+		}
+		file.partial = false
+	} else {
+		err := file.ensureDataFetched()
+		if err != 0 {
+			return err
 		}
-		file.data = &bytes
 	}
+	// Extending a file leaves a hole, so the zeroes don't take up any space
+	if err := file.spool.Truncate(size); err != nil {
+		log.Println("Error when truncating:", err)
+		return syscall.EIO
+	}
+	file.length = size
+	file.dirty = true
 	return 0
 }
 
+// Must be called with the lock held, and data fetched
+func (file *iCloudFile) size() int64 {
+	return file.length
+}
+
 func (file *iCloudFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	file.Lock()
+	defer file.Unlock()
 	err := file.ensureDataFetched()
 	if err != 0 {
 		return nil, err
 	}
-	bytes := *file.data
-	end := int(off) + len(dest)
-	if end > len(bytes) {
-		end = len(bytes)
+	n, readErr := file.contents().ReadAt(dest, off)
+	if readErr != nil && readErr != io.EOF {
+		log.Println("Error when reading:", readErr)
+		return nil, syscall.EIO
 	}
-	copy(dest, bytes[off:end])
-	return fuse.ReadResultData(dest), 0
+	return fuse.ReadResultData(dest[:n]), 0
 }
 
 func (file *iCloudFile) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
-	err := file.ensureDataFetched()
-	if err != 0 {
-		return 0, err
+	file.Lock()
+	defer file.Unlock()
+	if file.append {
+		// Appends go to the end of what's in iCloud, which isn't necessarily the size the kernel knows about
+		err := file.ensureDataFetched()
+		if err != 0 {
+			return 0, err
+		}
+		off = file.size()
+	} else if file.spool == nil && file.writeOnly && off == 0 {
+		// Nothing can be read from this handle, so as long as the writes start from the beginning, we can put off downloading the rest
+		if errno := file.openSpool(); errno != 0 {
+			return 0, errno
+		}
+		file.partial = true
+	}
+	if !file.partial || off != file.length {
+		err := file.ensureDataFetched()
+		if err != 0 {
+			return 0, err
+		}
+	}
+	if _, err := file.spool.WriteAt(data, off); err != nil {
+		log.Println("Error when writing:", err)
+		return 0, syscall.EIO
 	}
-	// FIXME: Incorrect offset here it seems, if trying to echo to the end of file we still get 0
-	end := int64(len(data)) + off
-	if int64(len(*file.data)) < end {
-		n := make([]byte, end)
-		copy(n, *file.data)
-		*file.data = n
+	if end := int64(len(data)) + off; end > file.length {
+		file.length = end
 	}
-	copy((*file.data)[off:end], data)
-	*file.data = (*file.data)[:end]
 	file.dirty = true
 	return uint32(len(data)), 0
 }
 
+// Called on every close(), including of dup'd descriptors, those are coalesced since nothing is uploaded unless there's been writes since the last upload.
+// POSIX locks should be released here as well, but go-fuse doesn't pass on which lock owner is closing, so that's done in Release instead.
 func (file *iCloudFile) Flush(ctx context.Context) syscall.Errno {
+	file.Lock()
+	defer file.Unlock()
+	return file.sync()
+}
+
+// Only returns once iCloud has stored the new version, so it's durable
+func (file *iCloudFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	file.Lock()
+	defer file.Unlock()
+	return file.sync()
+}
+
+// Called when the last descriptor is closed, uploads anything that's still not written (e.g. if flushing failed) and frees the data
+func (file *iCloudFile) Release(ctx context.Context) syscall.Errno {
+	file.Lock()
+	defer file.Unlock()
+	errno := file.sync()
+	if errno != 0 {
+		// The kernel doesn't pass this on to anyone, so the log is the only trace of it
+		log.Printf("Error: changes to %v were lost: %v", file.node.Filename(), errno)
+	}
+	file.free()
+	// The kernel expects locks to be released when the file is closed, but we're not told which ones, so release everything taken through this handle
+	file.inode.locks.releaseAll(file)
+	return 0
+}
+
+// Must be called with the lock held
+func (file *iCloudFile) free() {
+	if file.downloaded {
+		atomic.AddInt32(&file.inode.downloads, -1)
+		file.downloaded = false
+	}
+	file.closeSpool()
+	file.partial = false
+}
+
+// Uploads data if it has been modified since it was last uploaded. Must be called with the lock held.
+func (file *iCloudFile) sync() syscall.Errno {
 	if !file.dirty {
 		// NOOP
 		return 0
 	}
-	err := file.inode.drive.WriteData(file.inode.node, *file.data)
+	if file.partial && uint64(file.length) < file.node.Size {
+		// Only the start has been overwritten, so the rest has to be downloaded to keep it
+		errno := file.ensureDataFetched()
+		if errno != 0 {
+			return errno
+		}
+	}
+	file.partial = false
+	options := icloud.WriteOptions{
+		Mtime:    file.mtime,
+		Progress: uploadProgress(file.node.Filename()),
+	}
+	updated, err := file.inode.drive.WriteFrom(file.node, file.contents(), file.size(), options)
+	if errors.Is(err, icloud.ErrConflict) {
+		return file.handleConflict()
+	}
 	if err != nil {
-		log.Printf("Error when flushing: %v", err)
+		log.Printf("Error when uploading: %v", err)
 		// TODO: Probably wrong Errno here :/
 		return 1
 	}
 
-	// Notify parent that the content of this node has changed
-	parent := file.inode.parent
-	if parent != nil {
-		parent.ResetFileSystemCacheIfStale()
+	// Use the new metadata right away, so stat doesn't show the old size/mtime until the next poll.
+	// Unless this handle writes to a conflict copy, which isn't what the inode shows.
+	if updated.Drivewsid() == file.inode.getNode().Drivewsid() {
+		file.inode.setNode(updated)
+	}
+	// Further writes are based on what we just wrote
+	file.node = updated
+	file.dirty = false
+	if !file.mtime.IsZero() {
+		if !updated.DateChanged.Equal(file.mtime) {
+			// iCloud didn't store it, so keep it ourselves instead
+			file.inode.overlay.setMtime(updated, file.mtime)
+		}
+		file.mtime = time.Time{}
+	}
+	return 0
+}
+
+// Returns a reader for the whole file. Must be called with the lock held, and data fetched.
+func (file *iCloudFile) contents() *io.SectionReader {
+	return io.NewSectionReader(file.spool, 0, file.size())
+}
+
+// Uploads smaller than this aren't worth logging progress for
+const largeUpload = 16 * 1024 * 1024
+
+// Logs the progress of large uploads every 10%, so it's possible to tell that something is happening
+func uploadProgress(name string) icloud.ProgressFunc {
+	var logged int64
+	return func(sent int64, total int64) {
+		if total < largeUpload {
+			return
+		}
+		percent := sent * 100 / total
+		if percent >= logged+10 {
+			log.Printf("Uploading %v: %d%%", name, percent)
+			logged = percent
+		}
+	}
+}
+
+// Called when the node has been modified remotely since we fetched it, so writing would overwrite someone else's changes
+func (file *iCloudFile) handleConflict() syscall.Errno {
+	parent := file.inode.getParent()
+	if file.inode.options.Conflict == conflictFail || parent == nil {
+		log.Printf("Not writing %v, it has been modified remotely", file.node.Filename())
+		return syscall.ESTALE
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	// There might be conflict copies from earlier already
+	dir, err := file.inode.drive.RefreshNodeData(parent.getNode())
+	if err != nil {
+		log.Printf("Error when saving conflict copy: %v", err)
+		return syscall.EIO
+	}
+	children, err := file.inode.drive.GetChildren(dir)
+	if err != nil {
+		log.Printf("Error when saving conflict copy: %v", err)
+		return syscall.EIO
+	}
+	name := icloud.FreeName(children, fmt.Sprintf("%s (conflict from %s)", file.node.Name, hostname), file.node.Extension)
+	copy, err := file.inode.drive.CreateFileFrom(dir, name, file.node.Extension, file.contents(), file.size())
+	if err != nil {
+		log.Printf("Error when saving conflict copy: %v", err)
+		return syscall.EIO
 	}
+	log.Printf("%v has been modified remotely, saved as: %v", file.node.Filename(), copy.Filename())
+	// Our data is saved, and further writes through this handle go to the copy, instead of creating more of them
+	file.node = copy
+	file.dirty = false
+	parent.invalidate(&icloud.Changes{All: true})
 	return 0
 }
 
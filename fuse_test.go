@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/cheif/docker-volume-icloud/icloud"
+	"github.com/cheif/docker-volume-icloud/icloud/icloudtest"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/pmezard/go-difflib/difflib"
@@ -181,6 +185,259 @@ func TestEchoAndRead(t *testing.T) {
 	}
 }
 
+func TestStatfs(t *testing.T) {
+	inode, err := createInode()
+	if err != nil {
+		t.Error(err)
+	}
+	server, err := fs.Mount("/mnt/volumes", inode, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer server.Unmount()
+
+	var stat syscall.Statfs_t
+	err = syscall.Statfs("/mnt/volumes", &stat)
+	if err != nil {
+		t.Error(err)
+	}
+	if stat.Blocks == 0 {
+		t.Errorf("No capacity reported by Statfs: %+v", stat)
+	}
+	if stat.Bfree > stat.Blocks {
+		t.Errorf("More free blocks than total: %v > %v", stat.Bfree, stat.Blocks)
+	}
+}
+
+func TestCreateExclusive(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1"},
+		},
+	}
+	options := defaultVolumeOptions()
+	options.Permissions = true
+	root := newFakeRoot(t, icloudtest.NewDrive(t, folders), &options)
+
+	var out fuse.EntryOut
+	_, _, _, errno := root.Create(context.Background(), "notes.txt", syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY, 0644, &out)
+	if errno != syscall.EEXIST {
+		t.Errorf("Expected EEXIST, got: %v", errno)
+	}
+
+	_, fh, _, errno := root.Create(context.Background(), "new.txt", syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*iCloudFile).free()
+	if out.Mode&07777 != 0600 {
+		t.Errorf("Incorrect mode: %o", out.Mode&07777)
+	}
+	if len(folders["FOLDER::com.apple.CloudDocs::root"]) != 2 {
+		t.Errorf("Expected new.txt to be created, got: %+v", folders["FOLDER::com.apple.CloudDocs::root"])
+	}
+}
+
+func TestConflictWithUnfetchedWrites(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1", Size: 3},
+		},
+	}
+	server := icloudtest.NewServer(t, folders)
+	server.Contents["notes"] = []byte("abc")
+	options := defaultVolumeOptions()
+	options.Conflict = conflictFail
+	root := newFakeRoot(t, server.Drive(), &options)
+	var out fuse.EntryOut
+	child, errno := root.Lookup(context.Background(), "notes.txt", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh, _, errno := child.Operations().(*iCloudInode).Open(context.Background(), syscall.O_WRONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	file := fh.(*iCloudFile)
+	defer file.free()
+	// Only overwrites the start, so nothing is downloaded yet
+	if _, errno := file.Write(context.Background(), []byte("x"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	// Someone else modifies the file before the rest is downloaded
+	server.Lock()
+	folders["FOLDER::com.apple.CloudDocs::root"][0].Etag = "2"
+	server.Contents["notes"] = []byte("def")
+	server.Unlock()
+
+	if errno := file.Flush(context.Background()); errno != syscall.ESTALE {
+		t.Errorf("Expected ESTALE, got: %v", errno)
+	}
+	if server.Uploads != 0 || string(server.Contents["notes"]) != "def" {
+		t.Errorf("Remote changes were overwritten: %q", server.Contents["notes"])
+	}
+}
+
+func TestConflictCopyIsOnlySavedOnce(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1", Size: 3},
+		},
+	}
+	server := icloudtest.NewServer(t, folders)
+	server.Contents["notes"] = []byte("abc")
+	options := defaultVolumeOptions()
+	mountpoint := mountFake(t, newFakeRoot(t, server.Drive(), &options))
+
+	f, err := os.OpenFile(mountpoint+"/notes.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+	server.Lock()
+	folders["FOLDER::com.apple.CloudDocs::root"][0].Etag = "2"
+	server.Contents["notes"] = []byte("def")
+	server.Unlock()
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Keeps writing to the copy
+	if _, err := f.WriteAt([]byte("y"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Lock()
+	defer server.Unlock()
+	items := folders["FOLDER::com.apple.CloudDocs::root"]
+	if len(items) != 2 {
+		t.Fatalf("Expected a single conflict copy, got: %+v", items)
+	}
+	if string(server.Contents["notes"]) != "def" || string(server.Contents[items[1].Docwsid]) != "xyc" {
+		t.Errorf("Incorrect contents, original: %q, copy: %q", server.Contents["notes"], server.Contents[items[1].Docwsid])
+	}
+}
+
+func TestUploadsAreCoalesced(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1", Size: 3},
+		},
+	}
+	server := icloudtest.NewServer(t, folders)
+	server.Contents["notes"] = []byte("abc")
+	options := defaultVolumeOptions()
+	root := newFakeRoot(t, server.Drive(), &options)
+	var out fuse.EntryOut
+	child, errno := root.Lookup(context.Background(), "notes.txt", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	inode := child.Operations().(*iCloudInode)
+	ctx := context.Background()
+
+	fh, _, errno := inode.Open(ctx, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	file := fh.(*iCloudFile)
+	if _, errno := file.Write(ctx, []byte("x"), 3); errno != 0 {
+		t.Fatal(errno)
+	}
+	// e.g. close() of a dup'd descriptor, then fsync() and close() of the last one
+	for _, errno := range []syscall.Errno{file.Flush(ctx), file.Fsync(ctx, 0), file.Flush(ctx), file.Release(ctx)} {
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	if server.Uploads != 1 || string(server.Contents["notes"]) != "abcx" {
+		t.Errorf("Expected a single upload, got: %v, %q", server.Uploads, server.Contents["notes"])
+	}
+
+	// Only read from, so there's nothing to upload
+	fh, _, errno = inode.Open(ctx, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	file = fh.(*iCloudFile)
+	if _, errno := file.Read(ctx, make([]byte, 4), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	for _, errno := range []syscall.Errno{file.Flush(ctx), file.Fsync(ctx, 0), file.Release(ctx)} {
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	if server.Uploads != 1 {
+		t.Errorf("Expected nothing to be uploaded, got: %v", server.Uploads)
+	}
+}
+
+func TestInvalidateCaseInsensitiveNames(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1", Size: 3},
+		},
+	}
+	server := icloudtest.NewServer(t, folders)
+	options := defaultVolumeOptions()
+	options.CaseInsensitive = true
+	root := newFakeRoot(t, server.Drive(), &options)
+	mountpoint := mountFake(t, root)
+
+	if _, err := os.Stat(mountpoint + "/NOTES.TXT"); err != nil {
+		t.Fatal(err)
+	}
+	server.Lock()
+	folders["FOLDER::com.apple.CloudDocs::root"][0].Etag = "2"
+	folders["FOLDER::com.apple.CloudDocs::root"][0].Size = 5
+	server.Unlock()
+	root.invalidateTree(&icloud.Changes{All: true})
+
+	// Known by the kernel by the name it was looked up with
+	stat, err := os.Stat(mountpoint + "/NOTES.TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != 5 {
+		t.Errorf("Stale size: %v", stat.Size())
+	}
+}
+
+// Returns the root of a filesystem backed by drive, which works without being mounted as long as nothing notifies the kernel
+func newFakeRoot(t *testing.T, drive *icloud.Drive, options *volumeOptions) *iCloudInode {
+	node, err := drive.GetRootNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay, _ := newMetadataOverlay("")
+	root := newRootInode(drive, node, options, overlay)
+	// Sets up what's needed to create child inodes
+	fs.NewNodeFS(root, &fs.Options{})
+	return root
+}
+
+// Mounts root in a temporary directory, skipping the test if FUSE isn't available
+func mountFake(t *testing.T, root *iCloudInode) string {
+	mountpoint := t.TempDir()
+	server, err := fs.Mount(mountpoint, root, &fs.Options{MountOptions: fuse.MountOptions{DirectMount: true}})
+	if err != nil {
+		t.Skipf("Can't mount: %v", err)
+	}
+	t.Cleanup(func() { server.Unmount() })
+	return mountpoint
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
 func diff(a, b string) string {
 	diff := difflib.UnifiedDiff{
 		A:        difflib.SplitLines(a),
@@ -230,11 +487,9 @@ func createInode() (*iCloudInode, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Connecting to drive failed: %v\n", err)
 	}
-	inode := iCloudInode{
-		node:  node,
-		drive: *drive,
-	}
-	return &inode, nil
+	options := defaultVolumeOptions()
+	overlay, _ := newMetadataOverlay("")
+	return newRootInode(drive, node, &options, overlay), nil
 }
 
 func debugOpts() *fs.Options {
@@ -247,3 +502,211 @@ func debugOpts() *fs.Options {
 		AttrTimeout:  &timeout,
 	}
 }
+
+func TestInodeTableCollisions(t *testing.T) {
+	table := newInodeTable()
+	first := table.allocate("FILE::a", 42)
+	second := table.allocate("FILE::b", 42)
+	if first != 42 || second != 43 {
+		t.Errorf("Collision not handled, got: %v and %v", first, second)
+	}
+	if again := table.allocate("FILE::a", 42); again != first {
+		t.Errorf("Inode number not stable, was: %v, now: %v", first, again)
+	}
+	if reserved := table.allocate("FILE::c", ^uint64(0)); reserved == ^uint64(0) || reserved <= 1 {
+		t.Errorf("Reserved inode number allocated: %v", reserved)
+	}
+}
+
+func TestInodeTablePruning(t *testing.T) {
+	root := newFakeRoot(t, icloudtest.NewDrive(t, map[string][]icloud.NodeDataItem{"FOLDER::com.apple.CloudDocs::root": {}}), &volumeOptions{})
+	table := root.inodes
+	if len(table.byId) != 1 {
+		t.Fatalf("Expected only the root, got: %v", table.byId)
+	}
+	listed := table.peek("FILE::listed", 42)
+	looked := table.allocate("FILE::looked", 42)
+	if listed != 42 || looked != 42 || len(table.byId) != 2 {
+		t.Errorf("Listing kept the number: %v, %v, %v", listed, looked, table.byId)
+	}
+
+	// The first time it's too recent, it might be just about to get its inode. Nothing else uses the table, so there's no need to lock it.
+	table.prune()
+	if _, ok := table.byId["FILE::looked"]; !ok {
+		t.Errorf("Recently allocated number was pruned")
+	}
+	table.prune()
+	if _, ok := table.byId["FILE::looked"]; ok || len(table.byId) != 1 {
+		t.Errorf("Number without an inode was kept: %v", table.byId)
+	}
+}
+
+func TestInodeParentAfterRemoteMove(t *testing.T) {
+	notes := icloud.NodeDataItem{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1"}
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FOLDER::com.apple.CloudDocs::a", Docwsid: "a", Name: "a", Type: icloud.TypeFolder},
+			{Drivewsid: "FOLDER::com.apple.CloudDocs::b", Docwsid: "b", Name: "b", Type: icloud.TypeFolder},
+		},
+		"FOLDER::com.apple.CloudDocs::a": {notes},
+		"FOLDER::com.apple.CloudDocs::b": {},
+	}
+	server := icloudtest.NewServer(t, folders)
+	options := defaultVolumeOptions()
+	root := newFakeRoot(t, server.Drive(), &options)
+	ctx := context.Background()
+	lookup := func(dir *iCloudInode, name string) *iCloudInode {
+		var out fuse.EntryOut
+		child, errno := dir.Lookup(ctx, name, &out)
+		if errno != 0 {
+			t.Fatalf("Looking up %v: %v", name, errno)
+		}
+		return child.Operations().(*iCloudInode)
+	}
+	a := lookup(root, "a")
+	before := lookup(a, "notes.txt")
+
+	server.Lock()
+	folders["FOLDER::com.apple.CloudDocs::a"] = nil
+	folders["FOLDER::com.apple.CloudDocs::b"] = []icloud.NodeDataItem{notes}
+	server.Unlock()
+	after := lookup(lookup(root, "b"), "notes.txt")
+	if after != before {
+		t.Fatalf("Expected the inode to be reused")
+	}
+	if parent := after.getParent(); parent.getNode().Name != "b" {
+		t.Errorf("Incorrect parent: %v", parent.getNode().Name)
+	}
+}
+
+func TestTruncateGrowsWithZeroes(t *testing.T) {
+	file := spooledFile(t, nil, "abc")
+	if errno := file.truncate(8); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno := file.Write(context.Background(), []byte("xy"), 5); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := file.truncate(10); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	contents, err := io.ReadAll(file.contents())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "abc\x00\x00xy\x00\x00\x00"
+	if string(contents) != expected {
+		t.Errorf("Incorrect contents: %q, expected: %q", contents, expected)
+	}
+
+	dest := make([]byte, 4)
+	result, errno := file.Read(context.Background(), dest, 6)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	read, _ := result.Bytes(nil)
+	if string(read) != "y\x00\x00\x00" {
+		t.Errorf("Incorrect read: %q", read)
+	}
+
+	if errno := file.truncate(2); errno != 0 {
+		t.Fatal(errno)
+	}
+	if file.size() != 2 || !file.dirty {
+		t.Errorf("Incorrect size after shrinking: %v", file.size())
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	options := defaultVolumeOptions()
+	options.Permissions = true
+	options.Uid = 1000
+	overlay, _ := newMetadataOverlay("")
+	inode := newRootInode(nil, &icloud.Node{Name: "script"}, &options, overlay)
+
+	owner := &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}}
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: 0755}}
+	var out fuse.AttrOut
+	if errno := inode.Setattr(owner, nil, in, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Mode&07777 != 0755 {
+		t.Errorf("Incorrect mode: %o", out.Mode)
+	}
+
+	other := &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 1001, Gid: 1001}}}
+	if errno := inode.Setattr(other, nil, in, &out); errno != syscall.EPERM {
+		t.Errorf("Expected EPERM for other user, got: %v", errno)
+	}
+	in = &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_UID, Owner: fuse.Owner{Uid: 0}}}
+	if errno := inode.Setattr(owner, nil, in, &out); errno != syscall.EPERM {
+		t.Errorf("Expected EPERM when giving away file, got: %v", errno)
+	}
+
+	root := &fuse.Context{}
+	in = &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_UID | fuse.FATTR_GID, Owner: fuse.Owner{Uid: 33, Gid: 33}}}
+	if errno := inode.Setattr(root, nil, in, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Owner.Uid != 33 || out.Owner.Gid != 33 || out.Mode&07777 != 0755 {
+		t.Errorf("Incorrect attributes: %v", out)
+	}
+}
+
+func TestTruncateUnflushedWrites(t *testing.T) {
+	options := defaultVolumeOptions()
+	overlay, _ := newMetadataOverlay("")
+	inode := newRootInode(nil, &icloud.Node{Name: "notes", Size: 3}, &options, overlay)
+	file := spooledFile(t, inode, "abc")
+	if _, errno := file.Write(context.Background(), []byte("xyz"), 3); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	// Back to the size iCloud knows about, which isn't what the handle holds
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 3}}
+	var out fuse.AttrOut
+	if errno := inode.Setattr(context.Background(), file, in, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	contents, err := io.ReadAll(file.contents())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "abc" {
+		t.Errorf("Incorrect contents: %q", contents)
+	}
+}
+
+// Returns a handle for inode, as if contents had been downloaded
+func spooledFile(t *testing.T, inode *iCloudInode, contents string) *iCloudFile {
+	file := &iCloudFile{inode: inode}
+	if errno := file.openSpool(); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, err := file.spool.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	file.length = int64(len(contents))
+	t.Cleanup(file.closeSpool)
+	return file
+}
+
+func TestSpoolWriterKeepsWrittenPrefix(t *testing.T) {
+	file := spooledFile(t, nil, "NEW")
+	w := &spoolWriter{file: file.spool, skip: file.length}
+	// Downloaded in several parts, like a response body
+	for _, part := range []string{"ol", "d contents"} {
+		if _, err := w.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.length = w.written
+	contents, err := io.ReadAll(file.contents())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "NEW contents" {
+		t.Errorf("Incorrect contents: %q", contents)
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/docker/go-plugins-helpers v0.0.0-20211224144127-6eecb7beb651
 	github.com/hanwen/go-fuse/v2 v2.4.0
 	github.com/pmezard/go-difflib v1.0.0
+	golang.org/x/text v0.9.0
 )
 
 require (
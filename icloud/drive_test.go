@@ -0,0 +1,341 @@
+package icloud_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+	"github.com/cheif/docker-volume-icloud/icloud/icloudtest"
+)
+
+func TestConcurrentLookupsAndRefreshes(t *testing.T) {
+	drive := icloudtest.NewDrive(t, map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FOLDER::com.apple.CloudDocs::a", Docwsid: "a", Name: "a", Type: "FOLDER"},
+			{Drivewsid: "FILE::com.apple.CloudDocs::readme", Docwsid: "readme", Name: "readme", Extension: stringPtr("md"), Type: "FILE"},
+		},
+		"FOLDER::com.apple.CloudDocs::a": {
+			{Drivewsid: "FOLDER::com.apple.CloudDocs::b", Docwsid: "b", Name: "b", Type: "FOLDER"},
+		},
+		"FOLDER::com.apple.CloudDocs::b": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::file", Docwsid: "file", Name: "file", Extension: stringPtr("txt"), Type: "FILE"},
+		},
+	})
+	root, err := drive.GetRootNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			node, err := drive.GetNode("/a/b/file.txt")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if node.Filename() != "file.txt" {
+				t.Errorf("Incorrect node: %v", node.Filename())
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			children, err := drive.GetChildren(root)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, child := range children {
+				if child.Filename() == "a" {
+					if _, err := drive.GetChildren(child); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := drive.RefreshNodeData(root); err != nil {
+				t.Error(err)
+			}
+			root.HasCachedChildren()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestExtensionlessFilesAreNotDirectories(t *testing.T) {
+	drive := icloudtest.NewDrive(t, map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::makefile", Docwsid: "makefile", Name: "Makefile", Type: icloud.TypeFile},
+			{Drivewsid: "FOLDER::com.apple.CloudDocs::docs", Docwsid: "docs", Name: "docs.d", Type: icloud.TypeFolder},
+		},
+		"FOLDER::com.apple.CloudDocs::docs": {},
+	})
+	makefile, err := drive.GetNode("/Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if makefile.IsDir() {
+		t.Errorf("Makefile should not be a directory")
+	}
+	docs, err := drive.GetNode("/docs.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !docs.IsDir() {
+		t.Errorf("docs.d should be a directory")
+	}
+}
+
+func TestAppLibraries(t *testing.T) {
+	drive := icloudtest.NewDrive(t, map[string][]icloud.NodeDataItem{
+		icloudtest.AppLibraries: {
+			{Drivewsid: "FOLDER::com.apple.Pages::documents", Docwsid: "documents", Zone: "com.apple.Pages", Name: "Pages", Type: icloud.TypeAppLibrary},
+		},
+		"FOLDER::com.apple.Pages::documents": {
+			{Drivewsid: "FILE::com.apple.Pages::letter", Docwsid: "letter", Zone: "com.apple.Pages", Name: "Letter", Extension: stringPtr("pages"), Type: icloud.TypePackage},
+		},
+	})
+	pages, err := drive.GetContainerRoot("com.apple.Pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := drive.GetNodeIn(pages, "/Letter.pages", false); err != nil {
+		t.Error(err)
+	}
+	if _, err := drive.GetNodeIn(pages, "/letter.PAGES", false); err == nil {
+		t.Errorf("Expected names to be case-sensitive")
+	}
+	if _, err := drive.GetNodeIn(pages, "/letter.PAGES", true); err != nil {
+		t.Error(err)
+	}
+
+	all, err := drive.GetContainerRoot(icloud.ContainerAppLibraries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letter, err := drive.GetNodeIn(all, "/Pages/Letter.pages", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if letter.Zone() != "com.apple.Pages" {
+		t.Errorf("Incorrect zone: %v", letter.Zone())
+	}
+	if _, err := drive.RefreshNodeData(all); err != nil {
+		t.Error(err)
+	}
+	if err := drive.CreateFile(all, "new", nil, []byte{}); err == nil {
+		t.Errorf("Expected error when creating a file among the app libraries")
+	}
+	newLibrary := &icloud.Changes{Documents: []icloud.ChangedItem{{Drivewsid: "FILE::com.apple.Numbers::sheet", ParentId: "FOLDER::com.apple.Numbers::documents"}}}
+	if !newLibrary.HasChangedChildren(all) {
+		t.Errorf("Expected a change in a new library to affect the app libraries")
+	}
+	cloudDocs := &icloud.Changes{Documents: []icloud.ChangedItem{{Drivewsid: "FILE::com.apple.CloudDocs::notes", ParentId: "FOLDER::com.apple.CloudDocs::root"}}}
+	if cloudDocs.HasChangedChildren(all) {
+		t.Errorf("Expected a change in iCloud icloud.Drive to not affect the app libraries")
+	}
+
+	if _, err := drive.GetContainerRoot("com.example.Missing"); err == nil {
+		t.Errorf("Expected error for missing container")
+	}
+}
+
+func TestWriteDataDetectsRemoteModification(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Zone: "com.apple.CloudDocs", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1"},
+		},
+	}
+	drive := icloudtest.NewDrive(t, folders)
+	node, err := drive.GetNode("/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else modifies the file
+	folders["FOLDER::com.apple.CloudDocs::root"][0].Etag = "2"
+
+	_, err = drive.WriteData(node, []byte("ours"))
+	if !errors.Is(err, icloud.ErrConflict) {
+		t.Errorf("Expected icloud.ErrConflict, got: %v", err)
+	}
+}
+
+func TestWriteDataReturnsUpdatedNode(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Zone: "com.apple.CloudDocs", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1", Size: 2},
+		},
+	}
+	drive := icloudtest.NewDrive(t, folders)
+	node, err := drive.GetNode("/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := drive.WriteData(node, []byte("longer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Etag != "1+" || updated.Size != 6 || !updated.DateChanged.Equal(time.UnixMilli(icloudtest.DefaultMtime)) {
+		t.Errorf("Incorrect metadata: %v, %v, %v", updated.Etag, updated.Size, updated.DateChanged)
+	}
+	if icloud.ParentOf(node).CachedChildren()[0] != updated {
+		t.Errorf("Parent should have the updated node")
+	}
+
+	// Writing again shouldn't be seen as a conflict, since we know about our own change
+	mtime := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	updated, err = drive.WriteFrom(updated, bytes.NewReader([]byte("again")), 5, icloud.WriteOptions{Mtime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.DateChanged.Equal(mtime) {
+		t.Errorf("Mtime wasn't set: %v", updated.DateChanged)
+	}
+}
+
+func TestUploadRetriesTransientFailures(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Zone: "com.apple.CloudDocs", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1"},
+		},
+	}
+	server := icloudtest.NewServer(t, folders)
+	drive := icloud.NewDrive(http.Client{Transport: &failingTransport{RoundTripper: server.Transport(), path: "/upload", failures: 2}})
+	t.Cleanup(icloud.SetUploadRetryDelay(time.Millisecond))
+
+	node, err := drive.GetNode("/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("some data to upload")
+	var sent int64
+	updated, err := drive.WriteFrom(node, bytes.NewReader(data), int64(len(data)), icloud.WriteOptions{Progress: func(s int64, total int64) {
+		sent = s
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Size != uint64(len(data)) {
+		t.Errorf("Incorrect size: %v", updated.Size)
+	}
+	if sent != int64(len(data)) {
+		t.Errorf("Incorrect progress: %v", sent)
+	}
+}
+
+func TestUploadDoesNotRetryReadErrors(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Zone: "com.apple.CloudDocs", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1"},
+		},
+	}
+	transport := &failingTransport{RoundTripper: icloudtest.NewServer(t, folders).Transport(), path: "/upload"}
+	drive := icloud.NewDrive(http.Client{Transport: transport})
+	node, err := drive.GetNode("/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broken := errors.New("input/output error")
+	_, err = drive.WriteFrom(node, &brokenReader{err: broken}, 10, icloud.WriteOptions{})
+	if !errors.Is(err, broken) {
+		t.Errorf("Expected the read error, got: %v", err)
+	}
+	if transport.requests != 1 {
+		t.Errorf("Expected a single upload attempt, got: %v", transport.requests)
+	}
+}
+
+// Fails every read, like a file on a broken disk
+type brokenReader struct {
+	err error
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func (r *brokenReader) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+// Fails the first requests to path with a network error
+type failingTransport struct {
+	http.RoundTripper
+	path     string
+	failures int
+	// The number of requests to path
+	requests int
+}
+
+func (transport *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == transport.path {
+		transport.requests++
+	}
+	if req.URL.Path == transport.path && transport.failures > 0 {
+		transport.failures--
+		// Read some of the body, like a connection that breaks halfway through
+		if req.Body != nil {
+			req.Body.Read(make([]byte, 4))
+			req.Body.Close()
+		}
+		return nil, errors.New("connection reset by peer")
+	}
+	return transport.RoundTripper.RoundTrip(req)
+}
+
+func TestFolderMetadataFromChildren(t *testing.T) {
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	changed := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	count := uint64(3)
+	drive := icloudtest.NewDrive(t, map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FOLDER::com.apple.CloudDocs::docs", Name: "docs", Type: icloud.TypeFolder, DateCreated: created, DirectChildrenCount: &count},
+		},
+		"FOLDER::com.apple.CloudDocs::docs": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::a", Name: "a", Type: icloud.TypeFile, DateChanged: created},
+			{Drivewsid: "FILE::com.apple.CloudDocs::b", Name: "b", Type: icloud.TypeFile, DateChanged: changed},
+		},
+	})
+	root, err := drive.GetRootNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := drive.GetChildren(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := children[0]
+
+	// Before the children are fetched, all we know is what the parent listed
+	if !docs.LatestChange().Equal(created) {
+		t.Errorf("Incorrect latest change: %v", docs.LatestChange())
+	}
+	if items, ok := docs.ItemCount(); !ok || items != 3 {
+		t.Errorf("Incorrect item count: %v, %v", items, ok)
+	}
+
+	if _, err := drive.GetChildren(docs); err != nil {
+		t.Fatal(err)
+	}
+	if !docs.LatestChange().Equal(changed) {
+		t.Errorf("Incorrect latest change: %v", docs.LatestChange())
+	}
+	if items, ok := docs.ItemCount(); !ok || items != 2 {
+		t.Errorf("Incorrect item count: %v, %v", items, ok)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,16 @@
+package icloud
+
+import "time"
+
+// Lets the tests in icloud_test reach what they need of the internals
+
+func ParentOf(node *Node) *Node {
+	return node.parent
+}
+
+// Returns a function that restores the previous delay
+func SetUploadRetryDelay(delay time.Duration) func() {
+	previous := uploadRetryDelay
+	uploadRetryDelay = delay
+	return func() { uploadRetryDelay = previous }
+}
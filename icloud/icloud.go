@@ -3,6 +3,7 @@ package icloud
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -61,13 +62,17 @@ func AuthenticatedJar(accessToken string, webauthUser string) *CookieJar {
 	})
 }
 
+// A handle to the iCloud Drive of an account, this is meant to be shared (by pointer) by everything using the same account
 type Drive struct {
+	// Guards the change tracking state below
+	sync.Mutex
+
 	client             http.Client
 	continuationMarker *string
 }
 
-func NewDrive(client http.Client) Drive {
-	return Drive{
+func NewDrive(client http.Client) *Drive {
+	return &Drive{
 		client: client,
 	}
 }
@@ -138,7 +143,7 @@ func newDriveForSession(sessionData SessionData) (*Drive, *SessionData, error) {
 	drive := NewDrive(client)
 	err := drive.ValidateToken()
 	if err == nil {
-		return &drive, &sessionData, nil
+		return drive, &sessionData, nil
 	}
 	requires2FA, newSessionData, err := drive.authenticate(sessionData)
 	if err != nil {
@@ -152,7 +157,7 @@ func newDriveForSession(sessionData SessionData) (*Drive, *SessionData, error) {
 	if requires2FA {
 		return nil, nil, fmt.Errorf("Session requires 2fa, create a new instead")
 	}
-	return &drive, newSessionData, nil
+	return drive, newSessionData, nil
 }
 
 func CreateNewSessionInteractive(port string, storagePath string) (*Drive, error) {
@@ -211,7 +216,7 @@ func createNewSessionInteractive(port string) (*Drive, *SessionData, error) {
 		}
 		return newDriveForSession(*newSessionData)
 	} else {
-		return &drive, newSessionData, nil
+		return drive, newSessionData, nil
 	}
 }
 
@@ -447,13 +452,132 @@ type DsInfo struct {
 	HSAVersion   int    `json:"hsaVersion"`
 }
 
+// Fetches the storage quota and usage for the whole iCloud account, i.e. not only iCloud Drive
+func (drive *Drive) GetStorageUsage() (*StorageUsageInfo, error) {
+	req, err := http.NewRequest("POST", "https://setup.icloud.com/setup/ws/1/storageUsageInfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Origin", "https://www.icloud.com")
+	req.Header.Add("Accept", "application/json")
+	resp, err := drive.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Incorrect status code when fetching storage usage: %v", resp.StatusCode)
+	}
+	response := new(StorageUsageResponse)
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response.StorageUsageInfo, nil
+}
+
+type StorageUsageResponse struct {
+	StorageUsageInfo StorageUsageInfo `json:"storageUsageInfo"`
+}
+
+type StorageUsageInfo struct {
+	UsedStorageInBytes  uint64 `json:"usedStorageInBytes"`
+	TotalStorageInBytes uint64 `json:"totalStorageInBytes"`
+}
+
+const (
+	rootDrivewsid = "FOLDER::com.apple.CloudDocs::root"
+	// Not a real item in iCloud, but a folder we create that lists all app libraries
+	appLibrariesDrivewsid = "FOLDER::*::appLibraries"
+)
+
+// Container names that can be passed to GetContainerRoot
+const (
+	ContainerCloudDocs    = "com.apple.CloudDocs"
+	ContainerAppLibraries = "*"
+)
+
 func (drive *Drive) GetRootNode() (*Node, error) {
-	return drive.getNodeData("FOLDER::com.apple.CloudDocs::root")
+	return drive.getNodeData(rootDrivewsid)
+}
+
+// Returns the root node of a container, which is either the regular iCloud Drive (ContainerCloudDocs),
+// an app library identified by its zone (e.g. com.apple.Pages) or name, or a folder listing all app libraries (ContainerAppLibraries)
+func (drive *Drive) GetContainerRoot(container string) (*Node, error) {
+	switch container {
+	case "", ContainerCloudDocs:
+		return drive.GetRootNode()
+	case ContainerAppLibraries:
+		return drive.getAppLibrariesNode()
+	}
+	libraries, err := drive.GetAppLibraries()
+	if err != nil {
+		return nil, err
+	}
+	for _, library := range libraries {
+		if library.zone == container || library.Name == container || library.drivewsid == container {
+			return drive.GetNodeData(library)
+		}
+	}
+	return nil, fmt.Errorf("Could not find app library: %s", container)
+}
+
+// Lists the app-specific containers, e.g. Pages, Numbers or documents of third-party apps
+func (drive *Drive) GetAppLibraries() ([]*Node, error) {
+	req, err := http.NewRequest("GET", "https://p63-drivews.icloud.com/retrieveAppLibraries", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Origin", "https://www.icloud.com")
+	req.Header.Add("Accept", "application/json")
+	resp, err := drive.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	response := new(AppLibrariesResponse)
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	var libraries []*Node
+	for _, item := range response.Items {
+		libraries = append(libraries, newNode(item))
+	}
+	return libraries, nil
+}
+
+func (drive *Drive) getAppLibrariesNode() (*Node, error) {
+	libraries, err := drive.GetAppLibraries()
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{
+		drivewsid: appLibrariesDrivewsid,
+		docwsid:   appLibrariesDrivewsid,
+		Name:      "App Libraries",
+		Type:      TypeFolder,
+	}
+	node.setChildren(libraries)
+	return node, nil
+}
+
+type AppLibrariesResponse struct {
+	Items []NodeDataItem `json:"items"`
 }
 
 func (drive *Drive) GetNodeData(node *Node) (*Node, error) {
 	// This is a proxy for if this node already has all data, or if we need to fetch it to get children etc.
-	if node.shallow {
+	node.mu.RLock()
+	shallow := node.shallow
+	node.mu.RUnlock()
+	if shallow {
 		return drive.RefreshNodeData(node)
 	} else {
 		return node, nil
@@ -461,7 +585,13 @@ func (drive *Drive) GetNodeData(node *Node) (*Node, error) {
 }
 
 func (drive *Drive) RefreshNodeData(node *Node) (*Node, error) {
-	data, err := drive.getNodeData(node.drivewsid)
+	var data *Node
+	var err error
+	if node.drivewsid == appLibrariesDrivewsid {
+		data, err = drive.getAppLibrariesNode()
+	} else {
+		data, err = drive.getNodeData(node.drivewsid)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -502,7 +632,7 @@ func (drive *Drive) getNodeData(drivewsid string) (*Node, error) {
 	}
 	node := (*response)[0]
 
-	// TODO: For folders, use max(DateChanged) from children as DateChanged?
+	// Folders don't have a DateChanged of their own, see LatestChange for what's used instead
 	parent := &Node{
 		drivewsid:   node.Drivewsid,
 		docwsid:     node.Docwsid,
@@ -510,87 +640,254 @@ func (drive *Drive) getNodeData(drivewsid string) (*Node, error) {
 		shallow:     false,
 		Name:        node.Name,
 		Size:        node.Size,
+		Type:        node.Type,
 		Extension:   node.Extension,
 		Etag:        node.Etag,
 		DateCreated: node.DateCreated,
 	}
-	var children []Node
+	var children []*Node
 	for _, item := range node.Items {
-		children = append(children, Node{
-			drivewsid:   item.Drivewsid,
-			docwsid:     item.Docwsid,
-			zone:        item.Zone,
-			shallow:     item.Type == "FOLDER",
-			Name:        item.Name,
-			Size:        item.Size,
-			Extension:   item.Extension,
-			Etag:        item.Etag,
-			DateCreated: item.DateCreated,
-			DateChanged: item.DateChanged,
-		})
-	}
-	parent.setChildren(&children)
+		children = append(children, newNode(item))
+	}
+	parent.setChildren(children)
 	return parent, nil
 }
 
-func (node *Node) setChildren(children *[]Node) {
+func newNode(item NodeDataItem) *Node {
+	node := &Node{
+		drivewsid:   item.Drivewsid,
+		docwsid:     item.Docwsid,
+		zone:        item.Zone,
+		Name:        item.Name,
+		Size:        item.Size,
+		Type:        item.Type,
+		Extension:   item.Extension,
+		Etag:        item.Etag,
+		DateCreated: item.DateCreated,
+		DateChanged: item.DateChanged,
+
+		directChildrenCount: item.DirectChildrenCount,
+	}
+	// Folders are listed without their children, so those needs to be fetched separately
+	node.shallow = node.IsDir()
+	return node
+}
+
+// Returns true if the children of node have been fetched, and will be served from memory by GetChildren
+func (node *Node) HasCachedChildren() bool {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	return !node.shallow && node.children != nil
+}
+
+// Replaces the children of node. The slice is never modified after this, so it's safe to hand out to readers without copying.
+func (node *Node) setChildren(children []*Node) {
 	if children == nil {
 		return
 	}
-	for idx := range *children {
-		(*children)[idx].parent = node
+	for _, child := range children {
+		child.parent = node
 	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
 	node.children = children
+	node.names = nil
 	node.shallow = false
 }
 
+func (node *Node) getChildren() []*Node {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	return node.children
+}
+
+// Returns the children of node and their index, which is kept until the children are fetched again
+func (node *Node) nameIndex() ([]*Node, *nameIndex) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.names == nil {
+		node.names = newNameIndex(node.children)
+	}
+	return node.children, node.names
+}
+
+// Returns the cached children of node, and the names to present them as, see EntryNames. The names must not be modified.
+func (node *Node) EntryNames() ([]*Node, []string) {
+	children, index := node.nameIndex()
+	return children, index.names
+}
+
+// Like FindChild, but among the cached children of node
+func (node *Node) FindChild(name string, caseInsensitive bool) *Node {
+	children, index := node.nameIndex()
+	if i := index.find(name, caseInsensitive); i >= 0 {
+		return children[i]
+	}
+	return nil
+}
+
 // This tries to make sure that we dont keep stale references cached.
-// It does so by enumerating recent docs, which gives us a marker that we can then poll until iCloud tells us things have changed.
-// When this happens we get a new marker, and returns true, so that other parts of the package can re-fetch data.
+// It does so by enumerating recent docs, which gives us a marker that we can then poll for the items that have changed since.
+// If we can't tell what changed, e.g. on the first call, or when iCloud resets the marker, Changes.All is set, so that other parts of the package can re-fetch everything.
 //
 // This method was derived from observing what's happening on iCloud.com, and is indeed very crude, but seems to do the trick.
-func (drive *Drive) CheckIfHasNewChanges() (bool, error) {
-	var hasChanges bool
-	var err error
+func (drive *Drive) GetChanges() (*Changes, error) {
+	drive.Lock()
+	defer drive.Unlock()
 	if drive.continuationMarker != nil {
-		hasChanges, err = drive.checkHasChanges(*drive.continuationMarker)
+		changes, err := drive.listAllChanges(*drive.continuationMarker)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		if hasChanges {
-			drive.continuationMarker = nil
+		if changes != nil {
+			return changes, nil
 		}
 	}
 
-	if drive.continuationMarker == nil {
-		enumerate, err := drive.enumerateRecentDocs()
+	// Either we haven't got a marker yet, or it was reset, so we can't tell what has changed
+	enumerate, err := drive.enumerateRecentDocs()
+	if err != nil {
+		return nil, err
+	}
+	drive.continuationMarker = &enumerate.ContinuationMarker
+	return &Changes{All: true}, nil
+}
+
+// What has been changed remotely since the last call to GetChanges
+type Changes struct {
+	// All is set when we can't tell what has changed, and all cached data should be considered stale
+	All       bool
+	Documents []ChangedItem
+}
+
+// An item that has been added, modified, moved or deleted
+type ChangedItem struct {
+	Drivewsid string `json:"drivewsid"`
+	// The drivewsid of the folder the item is in now
+	ParentId string `json:"parentId"`
+	Etag     string `json:"etag"`
+}
+
+func (changes *Changes) IsEmpty() bool {
+	return !changes.All && len(changes.Documents) == 0
+}
+
+// Returns true if the contents or metadata of node itself has changed
+func (changes *Changes) HasChanged(node *Node) bool {
+	if changes.All {
+		return true
+	}
+	for _, item := range changes.Documents {
+		if item.Drivewsid == node.drivewsid {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if a child of node has been added, changed or removed
+func (changes *Changes) HasChangedChildren(node *Node) bool {
+	if changes.All {
+		return true
+	}
+	for _, item := range changes.Documents {
+		if item.ParentId == node.drivewsid {
+			return true
+		}
+		if node.IsVirtual() && zoneOf(item.Drivewsid) != ContainerCloudDocs {
+			// Something changed in an app library, which might be a new one, and there's no parent that would tell us that
+			return true
+		}
+	}
+	// Items that have been moved away or deleted are only listed with their new parent, if any
+	for _, child := range node.CachedChildren() {
+		if changes.HasChanged(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the zone of a drivewsid, which looks like TYPE::zone::docwsid
+func zoneOf(drivewsid string) string {
+	parts := strings.SplitN(drivewsid, "::", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// How many changes are listed per request
+const changesPageSize = 50
+
+// Lists the changes since continuationMarker, following the marker for as long as there are full pages, and stores the last one.
+// Returns nil if iCloud has reset the marker. Must be called with the lock held.
+func (drive *Drive) listAllChanges(continuationMarker string) (*Changes, error) {
+	changes := &Changes{}
+	marker := continuationMarker
+	for {
+		response, err := drive.listChanges(marker)
 		if err != nil {
-			return false, err
+			return nil, err
+		}
+		if response == nil {
+			return nil, nil
+		}
+		changes.Documents = append(changes.Documents, response.Changes...)
+		if response.ContinuationMarker == "" || response.ContinuationMarker == marker {
+			break
+		}
+		marker = response.ContinuationMarker
+		if len(response.Changes) < changesPageSize {
+			// There's nothing more
+			break
 		}
-		hasChanges = true
-		drive.continuationMarker = &enumerate.ContinuationMarker
 	}
-	return hasChanges, nil
+	drive.continuationMarker = &marker
+	return changes, nil
 }
 
-func (drive *Drive) checkHasChanges(continuationMarker string) (bool, error) {
-	url := fmt.Sprintf("https://p63-docws.icloud.com/ws/_all_/list/changes/recentDocs?limit=50&nextPage=%s", url.QueryEscape(continuationMarker))
+// Returns the items that have changed since continuationMarker, or nil if iCloud has reset the marker, which means that we can't tell
+func (drive *Drive) listChanges(continuationMarker string) (*ChangesResponse, error) {
+	url := fmt.Sprintf("https://p63-docws.icloud.com/ws/_all_/list/changes/recentDocs?limit=%d&nextPage=%s", changesPageSize, url.QueryEscape(continuationMarker))
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	req.Header.Add("Origin", "https://www.icloud.com")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
 	resp, err := drive.client.Do(req)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == 205 {
-		return true, nil
-	} else {
-		return false, nil
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Unexpected status when listing changes: %v", resp.Status)
+	}
+	if resp.StatusCode != 200 {
+		// e.g. 204, nothing has changed
+		return new(ChangesResponse), nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
+	response := new(ChangesResponse)
+	if len(body) == 0 {
+		// Nothing has changed
+		return response, nil
+	}
+	err = json.Unmarshal(body, &response)
+	return response, err
+}
+
+type ChangesResponse struct {
+	ContinuationMarker string        `json:"continuationMarker"`
+	Changes            []ChangedItem `json:"changes"`
 }
 
 func (drive *Drive) enumerateRecentDocs() (*EnumerateResponse, error) {
@@ -615,121 +912,267 @@ func (drive *Drive) enumerateRecentDocs() (*EnumerateResponse, error) {
 }
 
 type EnumerateResponse struct {
-	ContinuationMarker string `json:"continuationMarker"`
+	ContinuationMarker string           `json:"continuationMarker"`
+	Documents          []RecentDocument `json:"documents"`
+}
+
+type RecentDocument struct {
+	Docwsid  string `json:"document_id"`
+	ParentId string `json:"parent_id"`
+	Zone     string `json:"zone"`
+	Etag     string `json:"etag"`
 }
 
-func (drive *Drive) GetChildren(node *Node) (*[]Node, error) {
+// Returns the children of node, fetching them if they aren't cached. The returned slice must not be modified.
+func (drive *Drive) GetChildren(node *Node) ([]*Node, error) {
 	node, err := drive.GetNodeData(node)
 	if err != nil {
 		return nil, err
 	}
-	return node.children, nil
+	return node.getChildren(), nil
 }
 
 func (drive *Drive) GetNode(path string) (*Node, error) {
-	node, err := drive.GetRootNode()
+	root, err := drive.GetRootNode()
 	if err != nil {
 		return nil, err
 	}
+	return drive.GetNodeIn(root, path, false)
+}
+
+// Resolves path relative to root, matching names like FindChild does
+func (drive *Drive) GetNodeIn(root *Node, path string, caseInsensitive bool) (*Node, error) {
+	node := root
 	for _, component := range strings.Split(path, "/") {
 		if component == "" {
 			continue
 		}
-		var child *Node
-		for i, candidate := range *node.children {
-			if candidate.Filename() == component {
-				child, err = drive.GetNodeData(&candidate)
-				if err != nil {
-					return nil, err
-				}
-				if child != nil {
-					(*node.children)[i] = *child
-				}
-				break
-			}
+		dir, err := drive.GetNodeData(node)
+		if err != nil {
+			return nil, err
 		}
+		child := dir.FindChild(component, caseInsensitive)
 		if child == nil {
 			return nil, fmt.Errorf("Could not find component: %s", component)
 		}
-		node = child
+		node, err = drive.GetNodeData(child)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return node, nil
 }
 
 func (drive *Drive) GetData(node *Node) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	if err := drive.download(node, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Streams the contents of node to w, so that large files don't have to be kept in memory
+func (drive *Drive) download(node *Node, w io.Writer) error {
 	req, err := http.NewRequest(
 		"GET",
 		fmt.Sprintf("https://p63-docws.icloud.com/ws/%s/download/by_id?document_id=%s", node.zone, node.docwsid),
 		nil,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.Header.Add("Origin", "https://www.icloud.com")
 	resp, err := drive.client.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	response := new(DownloadInfo)
 	err = json.Unmarshal(body, &response)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	req, err = http.NewRequest("GET", response.DataToken.Url, nil)
+	downloadUrl := response.DataToken.Url
+	if node.Type == TypePackage {
+		// Packages are bundles of files, that iCloud serves as a zip-archive
+		downloadUrl = response.PackageToken.Url
+	}
+	req, err = http.NewRequest("GET", downloadUrl, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.Header.Add("Origin", "https://www.icloud.com")
 	resp, err = drive.client.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// TODO: We probably need more strict testing here, but it seems like iCloud responds with a 400 when the file doesn't exist, so we just check for that now
 	if resp.StatusCode == http.StatusBadRequest {
-		return []byte{}, nil
+		return nil
 	}
-	return io.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Like GetData, but streams the contents to w, instead of keeping them in memory
+func (drive *Drive) GetDataTo(node *Node, w io.Writer) error {
+	return drive.download(node, w)
 }
 
-func (drive *Drive) WriteData(node *Node, data []byte) error {
-	uploadData, err := drive.uploadFileData(node)
+// Returned when writing to a document that has been modified remotely since it was fetched
+var ErrConflict = errors.New("Document has been modified remotely")
+
+// Writes data to node, but only if it hasn't been modified remotely since node was fetched, otherwise ErrConflict is returned.
+// Returns a new Node with the metadata of what was written, that also replaces node in its parent.
+func (drive *Drive) WriteData(node *Node, data []byte) (*Node, error) {
+	return drive.WriteFrom(node, bytes.NewReader(data), int64(len(data)), WriteOptions{})
+}
+
+type WriteOptions struct {
+	// The modification time to store, if not set iCloud uses the current time
+	Mtime time.Time
+	// Called as the upload progresses
+	Progress ProgressFunc
+}
+
+// Like WriteData, but streams size bytes from reader instead of keeping it all in memory
+func (drive *Drive) WriteFrom(node *Node, reader io.ReadSeeker, size int64, options WriteOptions) (*Node, error) {
+	err := drive.checkUnchanged(node)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	buf := bytes.NewBuffer(data)
-	req, err := http.NewRequest("POST", uploadData.Url, buf)
-	resp, err := drive.client.Do(req)
+	fileData, err := drive.upload(node, reader, size, options.Progress)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result, err := drive.updateDocumentLink(node, *fileData, options.Mtime)
+	if err != nil {
+		return nil, err
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	var updated *Node
+	if result != nil && result.Document != nil && result.Document.Etag != "" {
+		document := result.Document
+		updated = node.withMetadata(document.Etag, document.Size, time.UnixMilli(document.Mtime))
+	} else {
+		// We didn't get the metadata back, so fetch it instead
+		current, err := drive.fetchCurrent(node)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%s disappeared while writing", node.Filename())
+		}
+		updated = node.withMetadata(current.Etag, current.Size, current.DateChanged)
+	}
+	if node.parent != nil {
+		node.parent.replaceChild(node, updated)
+	}
+	return updated, nil
+}
+
+// Creates a new file in parent, e.g. to keep a copy of data that couldn't be written because of a conflict
+func (drive *Drive) CreateFile(parent *Node, name string, extension *string, data []byte) error {
+	_, err := drive.CreateFileFrom(parent, name, extension, bytes.NewReader(data), int64(len(data)))
+	return err
+}
+
+// Like CreateFile, but streams the size bytes of contents from reader, and returns the created node
+func (drive *Drive) CreateFileFrom(parent *Node, name string, extension *string, reader io.ReadSeeker, size int64) (*Node, error) {
+	if parent.IsVirtual() {
+		return nil, fmt.Errorf("Can't create files in %s", parent.Name)
+	}
+	node := &Node{
+		zone:      parent.zone,
+		Name:      name,
+		Extension: extension,
+		Type:      TypeFile,
+	}
+	fileData, err := drive.upload(node, reader, size, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	response := new(UploadFileResponse)
-	err = json.Unmarshal(body, &response)
+	payload := UpdateDocumentLinkRequest{
+		Command: "add_file",
+		Data:    newUpdateDocumentData(*fileData),
+		Path: &UpdateDocumentPath{
+			StartingDocumentId: parent.docwsid,
+			Path:               node.Filename(),
+		},
+	}
+	_, err = drive.updateDocuments(node.zone, payload)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// iCloud doesn't tell us what it created, so look for it
+	parent, err = drive.RefreshNodeData(parent)
+	if err != nil {
+		return nil, err
+	}
+	children, err := drive.GetChildren(parent)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if child.Name == name && child.Filename() == node.Filename() {
+			return child, nil
+		}
+	}
+	return nil, fmt.Errorf("Created %s, but it isn't listed", node.Filename())
+}
+
+// Compares the Etag of node with what's currently in iCloud
+func (drive *Drive) checkUnchanged(node *Node) error {
+	if node.parent == nil {
+		// Nothing to compare with
+		return nil
 	}
-	err = drive.updateDocumentLink(node, response.SingleFile)
+	current, err := drive.fetchCurrent(node)
 	if err != nil {
 		return err
 	}
+	if current == nil || current.Etag != node.Etag {
+		// Modified or removed remotely
+		return ErrConflict
+	}
 	return nil
 }
 
+// Fetches the current metadata for node, by listing the parent, since that's what we know how to fetch.
+// Returns nil if node doesn't exist anymore.
+func (drive *Drive) fetchCurrent(node *Node) (*Node, error) {
+	if node.parent == nil {
+		return nil, fmt.Errorf("Can't fetch %s without a parent", node.Filename())
+	}
+	parent, err := drive.getNodeData(node.parent.drivewsid)
+	if err != nil {
+		return nil, err
+	}
+	for _, current := range parent.getChildren() {
+		if current.drivewsid == node.drivewsid {
+			return current, nil
+		}
+	}
+	return nil, nil
+}
+
 func (drive *Drive) uploadFileData(node *Node) (*UploadURLResponse, error) {
 	payload := UploadURLRequest{
 		Filename:    node.Filename(),
-		Type:        "FILE",
+		Type:        TypeFile,
 		ContentType: "",
 	}
+	if node.Type == TypePackage {
+		// Packages are uploaded as a zip-archive of their contents, the same way they're downloaded
+		payload.Type = TypePackage
+		payload.ContentType = "application/zip"
+	}
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode(payload)
 	req, err := http.NewRequest(
@@ -759,39 +1202,71 @@ func (drive *Drive) uploadFileData(node *Node) (*UploadURLResponse, error) {
 	return &(*response)[0], nil
 }
 
-func (drive *Drive) updateDocumentLink(node *Node, fileData UploadFileData) error {
+func (drive *Drive) updateDocumentLink(node *Node, fileData UploadFileData, mtime time.Time) (*UpdateDocumentResult, error) {
 	payload := UpdateDocumentLinkRequest{
 		DocumentId: node.docwsid,
 		Command:    "modify_file",
-		Data: UpdateDocumentData{
-			ReferenceSignature: fileData.ReferenceChecksum,
-			Signature:          fileData.FileChecksum,
-			WrappingKey:        fileData.WrappingKey,
-			Size:               fileData.Size,
-			Receipt:            fileData.Receipt,
-		},
-		/*
-			Path: UpdateDocumentPath{
-				StartingDocumentId: "",
-				Path:               node.Filename(),
-			},
-		*/
+		Data:       newUpdateDocumentData(fileData),
+	}
+	if !mtime.IsZero() {
+		payload.Mtime = mtime.UnixMilli()
+	}
+	return drive.updateDocuments(node.zone, payload)
+}
+
+func newUpdateDocumentData(fileData UploadFileData) UpdateDocumentData {
+	return UpdateDocumentData{
+		ReferenceSignature: fileData.ReferenceChecksum,
+		Signature:          fileData.FileChecksum,
+		WrappingKey:        fileData.WrappingKey,
+		Size:               fileData.Size,
+		Receipt:            fileData.Receipt,
 	}
+}
+
+// Returns the result for the updated document, if iCloud returned one
+func (drive *Drive) updateDocuments(zone string, payload UpdateDocumentLinkRequest) (*UpdateDocumentResult, error) {
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode(payload)
 	req, err := http.NewRequest(
 		"POST",
-		fmt.Sprintf("https://p63-docws.icloud.com/ws/%s/update/documents", node.zone),
+		fmt.Sprintf("https://p63-docws.icloud.com/ws/%s/update/documents", zone),
 		buf,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Add("Origin", "https://www.icloud.com")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	_, err = drive.client.Do(req)
-	return err
+	resp, err := drive.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Incorrect status code when updating document: %v, %v", resp.StatusCode, string(body))
+	}
+	response := new(UpdateDocumentsResponse)
+	if err := json.Unmarshal(body, &response); err != nil {
+		// We've only seen this fail for responses without a body, and those seem to mean success
+		return nil, nil
+	}
+	for _, result := range response.Results {
+		if strings.Contains(result.Status, "CONFLICT") {
+			// Someone modified the document between our check and the update
+			return nil, ErrConflict
+		} else if result.Status != "" && result.Status != "OK" {
+			return nil, fmt.Errorf("Error when updating document: %v", result.Status)
+		}
+	}
+	if len(response.Results) == 0 {
+		return nil, nil
+	}
+	return &response.Results[0], nil
 }
 
 type UploadURLRequest struct {
@@ -818,9 +1293,28 @@ type UploadFileData struct {
 }
 
 type UpdateDocumentLinkRequest struct {
-	DocumentId string             `json:"document_id"`
-	Command    string             `json:"command"`
-	Data       UpdateDocumentData `json:"data"`
+	DocumentId string              `json:"document_id,omitempty"`
+	Command    string              `json:"command"`
+	Data       UpdateDocumentData  `json:"data"`
+	Path       *UpdateDocumentPath `json:"path,omitempty"`
+	// Milliseconds since epoch
+	Mtime int64 `json:"mtime,omitempty"`
+}
+
+type UpdateDocumentsResponse struct {
+	Results []UpdateDocumentResult `json:"results"`
+}
+
+type UpdateDocumentResult struct {
+	Status   string           `json:"status"`
+	Document *UpdatedDocument `json:"document"`
+}
+
+type UpdatedDocument struct {
+	Etag string `json:"etag"`
+	Size uint64 `json:"size"`
+	// Milliseconds since epoch
+	Mtime int64 `json:"mtime"`
 }
 
 type UpdateDocumentData struct {
@@ -866,6 +1360,9 @@ type NodeDataItem struct {
 
 	DateCreated time.Time `json:"dateCreated"`
 	DateChanged time.Time `json:"dateChanged"`
+
+	// Only included for folders
+	DirectChildrenCount *uint64 `json:"directChildrenCount"`
 }
 
 type DataToken struct {
@@ -873,9 +1370,13 @@ type DataToken struct {
 }
 
 type DownloadInfo struct {
-	DataToken DataToken `json:"data_token"`
+	DataToken    DataToken `json:"data_token"`
+	PackageToken DataToken `json:"package_token"`
 }
 
+// A file or folder in iCloud Drive.
+// The exported metadata is never modified once a Node has been returned from this package, so it can be read without locking,
+// while the children are guarded by mu, since they're fetched lazily and replaced on refresh.
 type Node struct {
 	drivewsid   string
 	zone        string
@@ -883,13 +1384,121 @@ type Node struct {
 	shallow     bool
 	Name        string
 	Size        uint64
+	Type        string
 	Extension   *string
 	Etag        string
 	DateCreated time.Time
 	DateChanged time.Time
+	// The number of items in a folder, as listed by its parent, nil if it wasn't included
+	directChildrenCount *uint64
+
+	parent *Node
+
+	mu       sync.RWMutex
+	children []*Node
+	// Built from children when first needed
+	names *nameIndex
+}
+
+// The types of items that iCloud Drive returns
+const (
+	TypeFile       = "FILE"
+	TypeFolder     = "FOLDER"
+	TypeAppLibrary = "APP_LIBRARY"
+	TypePackage    = "PACKAGE"
+)
+
+// Returns true if node can have children, packages are treated as files since they're downloaded as a whole
+func (node *Node) IsDir() bool {
+	return node.Type == TypeFolder || node.Type == TypeAppLibrary
+}
+
+// Returns true for folders that only exist in this package, like the one listing all app libraries, which nothing can be created in
+func (node *Node) IsVirtual() bool {
+	return node.drivewsid == appLibrariesDrivewsid
+}
+
+// Returns a copy of node with new metadata, since the metadata of a Node is never modified
+func (node *Node) withMetadata(etag string, size uint64, dateChanged time.Time) *Node {
+	return &Node{
+		drivewsid:   node.drivewsid,
+		zone:        node.zone,
+		docwsid:     node.docwsid,
+		shallow:     node.shallow,
+		Name:        node.Name,
+		Size:        size,
+		Type:        node.Type,
+		Extension:   node.Extension,
+		Etag:        etag,
+		DateCreated: node.DateCreated,
+		DateChanged: dateChanged,
+		parent:      node.parent,
+
+		directChildrenCount: node.directChildrenCount,
+	}
+}
+
+// Returns when node was last changed. iCloud doesn't track that for folders, so for those it's the latest change of its children,
+// if they've been fetched, otherwise when it was created.
+func (node *Node) LatestChange() time.Time {
+	latest := node.DateChanged
+	if node.HasCachedChildren() {
+		for _, child := range node.getChildren() {
+			if child.DateChanged.After(latest) {
+				latest = child.DateChanged
+			}
+		}
+	}
+	if latest.IsZero() {
+		return node.DateCreated
+	}
+	return latest
+}
+
+// Returns the number of items in a folder, and false if it isn't known without fetching its children
+func (node *Node) ItemCount() (uint64, bool) {
+	if node.HasCachedChildren() {
+		return uint64(len(node.getChildren())), true
+	}
+	if node.directChildrenCount != nil {
+		return *node.directChildrenCount, true
+	}
+	return 0, false
+}
+
+// Returns the cached children of node, or nil if they haven't been fetched
+func (node *Node) CachedChildren() []*Node {
+	if !node.HasCachedChildren() {
+		return nil
+	}
+	return node.getChildren()
+}
+
+func (node *Node) replaceChild(old *Node, new *Node) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	children := make([]*Node, len(node.children))
+	for i, child := range node.children {
+		if child.drivewsid == old.drivewsid {
+			children[i] = new
+		} else {
+			children[i] = child
+		}
+	}
+	// The names stay the same, since only the metadata of the child changes
+	node.children = children
+}
+
+func (node *Node) Docwsid() string {
+	return node.docwsid
+}
+
+func (node *Node) Zone() string {
+	return node.zone
+}
 
-	parent   *Node
-	children *[]Node
+func (node *Node) Drivewsid() string {
+	return node.drivewsid
 }
 
 func (node *Node) Hash() uint64 {
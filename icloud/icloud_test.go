@@ -1,8 +1,12 @@
 package icloud
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 )
@@ -50,3 +54,107 @@ func TestValidateToken(t *testing.T) {
 		t.Errorf("ValidateToken didn't error out with empty token/user")
 	}
 }
+
+func TestGetChanges(t *testing.T) {
+	changesStatus := http.StatusOK
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/_all_/list/enumerate/recentDocs", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(EnumerateResponse{ContinuationMarker: "1"})
+	})
+	mux.HandleFunc("/ws/_all_/list/changes/recentDocs", func(w http.ResponseWriter, r *http.Request) {
+		marker := r.URL.Query().Get("nextPage")
+		switch {
+		case changesStatus != http.StatusOK:
+			w.WriteHeader(changesStatus)
+		case marker == "1":
+			// A full page, so there's more to fetch
+			response := ChangesResponse{ContinuationMarker: "2"}
+			for i := 0; i < changesPageSize; i++ {
+				response.Changes = append(response.Changes, ChangedItem{Drivewsid: fmt.Sprintf("FILE::com.apple.CloudDocs::%d", i), ParentId: "FOLDER::com.apple.CloudDocs::d"})
+			}
+			json.NewEncoder(w).Encode(response)
+		case marker == "2":
+			w.Write([]byte(`{"continuationMarker": "3", "changes": [
+				{"drivewsid": "FILE::com.apple.CloudDocs::modified", "parentId": "FOLDER::com.apple.CloudDocs::a", "etag": "2"},
+				{"drivewsid": "FILE::com.apple.CloudDocs::moved", "parentId": "FOLDER::com.apple.CloudDocs::c", "etag": "3"}
+			]}`))
+		case marker == "3":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("Unexpected marker: %v", marker)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	drive := NewDrive(http.Client{Transport: &rewriteTransport{target: target}})
+
+	changes, err := drive.GetChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.All {
+		t.Errorf("Expected the first call to report everything as changed")
+	}
+
+	changes, err = drive.GetChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.All {
+		t.Errorf("Expected only the listed items to be changed")
+	}
+	for _, id := range []string{"0", "modified", "moved"} {
+		if !changes.HasChanged(&Node{drivewsid: "FILE::com.apple.CloudDocs::" + id}) {
+			t.Errorf("Expected %s to be changed", id)
+		}
+	}
+	if changes.HasChanged(&Node{drivewsid: "FILE::com.apple.CloudDocs::unchanged"}) {
+		t.Errorf("Expected unchanged to not be changed")
+	}
+	moved := &Node{drivewsid: "FILE::com.apple.CloudDocs::moved"}
+	b := &Node{drivewsid: "FOLDER::com.apple.CloudDocs::b", children: []*Node{moved}}
+	for _, folder := range []*Node{{drivewsid: "FOLDER::com.apple.CloudDocs::a"}, b, {drivewsid: "FOLDER::com.apple.CloudDocs::c"}} {
+		if !changes.HasChangedChildren(folder) {
+			t.Errorf("Expected children of %s to be changed", folder.drivewsid)
+		}
+	}
+	if changes.HasChangedChildren(&Node{drivewsid: "FOLDER::com.apple.CloudDocs::e"}) {
+		t.Errorf("Expected children of e to not be changed")
+	}
+
+	// Nothing has changed since the last page
+	changes, err = drive.GetChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.IsEmpty() {
+		t.Errorf("Expected no changes, got: %+v", changes)
+	}
+
+	// iCloud resets the marker
+	changesStatus = http.StatusResetContent
+	changes, err = drive.GetChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.All {
+		t.Errorf("Expected a reset marker to report everything as changed")
+	}
+}
+
+// Sends all requests to target, regardless of which iCloud host they were meant for
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (transport *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = transport.target.Scheme
+	req.URL.Host = transport.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,217 @@
+// Package icloudtest serves a fake iCloud Drive from memory, so that code using the icloud package can be tested without an account.
+package icloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+)
+
+// The drivewsid that the app libraries are listed under in Folders
+const AppLibraries = "FOLDER::*::appLibraries"
+
+// What iCloud returns as the mtime of documents that are updated without one
+const DefaultMtime = 1700000000000
+
+type Server struct {
+	// Guards the fields below, which tests may modify between requests
+	sync.Mutex
+
+	// The items in each folder, keyed by the drivewsid of the folder
+	Folders map[string][]icloud.NodeDataItem
+	// The contents of documents, keyed by docwsid
+	Contents map[string][]byte
+	// The number of files that have been uploaded
+	Uploads int
+
+	t        testing.TB
+	server   *httptest.Server
+	receipts map[string][]byte
+	created  int
+}
+
+// Starts a server for folders, which is kept (not copied), so tests can modify it to simulate changes made elsewhere
+func NewServer(t testing.TB, folders map[string][]icloud.NodeDataItem) *Server {
+	s := &Server{
+		Folders:  folders,
+		Contents: map[string][]byte{},
+		t:        t,
+		receipts: map[string][]byte{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/retrieveItemDetailsInFolders", s.retrieveItemDetails)
+	mux.HandleFunc("/retrieveAppLibraries", func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+		json.NewEncoder(w).Encode(icloud.AppLibrariesResponse{Items: s.Folders[AppLibraries]})
+	})
+	mux.HandleFunc("/ws/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/download/by_id"):
+			download := "https://download.icloud.com/download?document_id=" + url.QueryEscape(r.URL.Query().Get("document_id"))
+			// Packages are served the same way as other documents, the contents are expected to be a zip-archive
+			json.NewEncoder(w).Encode(icloud.DownloadInfo{DataToken: icloud.DataToken{Url: download}, PackageToken: icloud.DataToken{Url: download}})
+		case strings.HasSuffix(r.URL.Path, "/upload/web"):
+			json.NewEncoder(w).Encode([]icloud.UploadURLResponse{{Url: "https://upload.icloud.com/upload"}})
+		case strings.HasSuffix(r.URL.Path, "/update/documents"):
+			s.updateDocuments(w, r)
+		default:
+			t.Errorf("Unexpected request: %v", r.URL.Path)
+		}
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+		w.Write(s.Contents[r.URL.Query().Get("document_id")])
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		s.Lock()
+		defer s.Unlock()
+		s.Uploads++
+		receipt := fmt.Sprintf("receipt-%d", s.Uploads)
+		s.receipts[receipt] = data
+		json.NewEncoder(w).Encode(icloud.UploadFileResponse{SingleFile: icloud.UploadFileData{Size: len(data), Receipt: receipt}})
+	})
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// Returns a Drive that sends all requests to this server
+func (s *Server) Drive() *icloud.Drive {
+	return icloud.NewDrive(http.Client{Transport: s.Transport()})
+}
+
+// Returns a transport that sends all requests to this server, regardless of which iCloud host they were meant for
+func (s *Server) Transport() http.RoundTripper {
+	target, _ := url.Parse(s.server.URL)
+	return &rewriteTransport{target: target}
+}
+
+// Shorthand for NewServer(t, folders).Drive()
+func NewDrive(t testing.TB, folders map[string][]icloud.NodeDataItem) *icloud.Drive {
+	return NewServer(t, folders).Drive()
+}
+
+func (s *Server) retrieveItemDetails(w http.ResponseWriter, r *http.Request) {
+	var request []icloud.GetNodeDataRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.t.Error(err)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	var response []icloud.GetNodeDataResponse
+	for _, folder := range request {
+		items, ok := s.Folders[folder.Drivewsid]
+		if !ok {
+			s.t.Errorf("Unknown folder: %v", folder.Drivewsid)
+		}
+		zone, docwsid := splitDrivewsid(folder.Drivewsid)
+		// Copied, so that the caller doesn't see later modifications
+		items = append([]icloud.NodeDataItem{}, items...)
+		for i := range items {
+			if items[i].Zone == "" {
+				items[i].Zone = zone
+			}
+		}
+		response = append(response, icloud.GetNodeDataResponse{
+			Drivewsid: folder.Drivewsid,
+			Docwsid:   docwsid,
+			Zone:      zone,
+			Type:      icloud.TypeFolder,
+			Items:     items,
+		})
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) updateDocuments(w http.ResponseWriter, r *http.Request) {
+	var request icloud.UpdateDocumentLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.t.Error(err)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	data := s.receipts[request.Data.Receipt]
+	if request.Command == "add_file" {
+		s.addFile(w, request, data)
+		return
+	}
+
+	// Behave like iCloud, and give the document a new etag
+	for _, items := range s.Folders {
+		for i, item := range items {
+			if item.Docwsid == request.DocumentId {
+				items[i].Etag += "+"
+				items[i].Size = uint64(request.Data.Size)
+				s.Contents[item.Docwsid] = data
+				mtime := request.Mtime
+				if mtime == 0 {
+					mtime = DefaultMtime
+				}
+				document := &icloud.UpdatedDocument{Etag: items[i].Etag, Size: items[i].Size, Mtime: mtime}
+				json.NewEncoder(w).Encode(icloud.UpdateDocumentsResponse{Results: []icloud.UpdateDocumentResult{{Status: "OK", Document: document}}})
+				return
+			}
+		}
+	}
+	s.t.Errorf("Unknown document: %v", request.DocumentId)
+}
+
+// Must be called with the lock held
+func (s *Server) addFile(w http.ResponseWriter, request icloud.UpdateDocumentLinkRequest, data []byte) {
+	for drivewsid := range s.Folders {
+		zone, docwsid := splitDrivewsid(drivewsid)
+		if docwsid != request.Path.StartingDocumentId {
+			continue
+		}
+		s.created++
+		name, extension := icloud.SplitFilename(request.Path.Path)
+		item := icloud.NodeDataItem{
+			Drivewsid: fmt.Sprintf("FILE::%s::created-%d", zone, s.created),
+			Docwsid:   fmt.Sprintf("created-%d", s.created),
+			Zone:      zone,
+			Name:      name,
+			Extension: extension,
+			Size:      uint64(len(data)),
+			Type:      icloud.TypeFile,
+			Etag:      "1",
+		}
+		s.Folders[drivewsid] = append(s.Folders[drivewsid], item)
+		s.Contents[item.Docwsid] = data
+		json.NewEncoder(w).Encode(icloud.UpdateDocumentsResponse{Results: []icloud.UpdateDocumentResult{{Status: "OK"}}})
+		return
+	}
+	s.t.Errorf("Unknown folder: %v", request.Path.StartingDocumentId)
+}
+
+// Returns the zone and docwsid of a drivewsid, which looks like TYPE::zone::docwsid
+func splitDrivewsid(drivewsid string) (string, string) {
+	parts := strings.SplitN(drivewsid, "::", 3)
+	if len(parts) < 3 {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (transport *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = transport.target.Scheme
+	req.URL.Host = transport.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
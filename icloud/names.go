@@ -0,0 +1,185 @@
+package icloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Returns the child with the given name, or nil if there's none. Names are the ones returned by EntryNames.
+// An exact match is always preferred, but if caseInsensitive is set, a match that only differs in case is returned if there's no exact one.
+func FindChild(children []*Node, name string, caseInsensitive bool) *Node {
+	if i := newNameIndex(children).find(name, caseInsensitive); i >= 0 {
+		return children[i]
+	}
+	return nil
+}
+
+// The names that children are presented as, and where to find them by name.
+// Sorting out the names is too slow to do for every lookup, so folders keep one of these along with their children.
+type nameIndex struct {
+	names  []string
+	exact  map[string]int
+	folded map[string]int
+}
+
+func newNameIndex(children []*Node) *nameIndex {
+	index := &nameIndex{
+		names:  EntryNames(children),
+		exact:  map[string]int{},
+		folded: map[string]int{},
+	}
+	for i, name := range index.names {
+		index.exact[name] = i
+		// The first one wins, like when matching them one by one
+		if _, ok := index.folded[FoldName(name)]; !ok {
+			index.folded[FoldName(name)] = i
+		}
+	}
+	return index
+}
+
+// Returns the index of the child called name, or -1
+func (index *nameIndex) find(name string, caseInsensitive bool) int {
+	name = NormalizeName(name)
+	if i, ok := index.exact[name]; ok {
+		return i
+	}
+	if i, ok := index.folded[FoldName(name)]; ok && caseInsensitive {
+		return i
+	}
+	return -1
+}
+
+// Returns what name is compared by when matching case-insensitively
+func FoldName(name string) string {
+	// Casers keep state, so can't be shared
+	return cases.Fold().String(name)
+}
+
+// Splits a name, as presented by EntryNames, into the name and extension that iCloud keeps separately, e.g. "notes.txt" into "notes" and "txt"
+func SplitFilename(name string) (string, *string) {
+	name = unescapeName(NormalizeName(name))
+	i := strings.LastIndex(name, ".")
+	if i <= 0 || i == len(name)-1 {
+		// Hidden files, like ".env", don't have an extension
+		return name, nil
+	}
+	extension := name[i+1:]
+	return name[:i], &extension
+}
+
+// Returns the names to present children as, in the same order.
+// Names are normalized, and characters that can't be part of a name on Linux are replaced.
+// iCloud allows several items with the same name, so if that happens all but the oldest get a suffix like "name (2).ext".
+// This is deterministic, so the same name always refers to the same item, as long as the folder doesn't change.
+func EntryNames(children []*Node) []string {
+	names := make([]string, len(children))
+	// All names that are used as-is, so that we don't generate a suffixed name that's already taken by another item
+	occurrences := map[string]int{}
+	for i, child := range children {
+		names[i] = escapeName(child.Name, child.Extension)
+		occurrences[names[i]]++
+	}
+
+	order := make([]int, len(children))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		first, second := children[order[a]], children[order[b]]
+		if !first.DateCreated.Equal(second.DateCreated) {
+			return first.DateCreated.Before(second.DateCreated)
+		}
+		return first.drivewsid < second.drivewsid
+	})
+
+	taken := map[string]bool{}
+	for _, i := range order {
+		if occurrences[names[i]] > 1 && taken[names[i]] {
+			child := children[i]
+			for n := 2; ; n++ {
+				candidate := escapeName(fmt.Sprintf("%s (%d)", child.Name, n), child.Extension)
+				if occurrences[candidate] == 0 && !taken[candidate] {
+					names[i] = candidate
+					break
+				}
+			}
+		}
+		taken[names[i]] = true
+	}
+	return names
+}
+
+// Returns name, or name with a suffix like " (2)" if something called that is already listed among children, the same way EntryNames disambiguates them
+func FreeName(children []*Node, name string, extension *string) string {
+	// iCloud is case-insensitive, as far as macOS is concerned
+	taken := map[string]bool{}
+	for _, entryName := range EntryNames(children) {
+		taken[FoldName(entryName)] = true
+	}
+	candidate := name
+	for n := 2; taken[FoldName(escapeName(candidate, extension))]; n++ {
+		candidate = fmt.Sprintf("%s (%d)", name, n)
+	}
+	return candidate
+}
+
+// Replacements for characters that can't be part of a name on Linux, these look the same but aren't special.
+// The replacements, and the escape character, are escaped themselves when they're really part of a name, so that the original name can always be restored.
+var nameReplacer = strings.NewReplacer(
+	"/", "∕", // DIVISION SLASH
+	"\x00", "␀", // SYMBOL FOR NULL
+	"∕", "␛∕", // SYMBOL FOR ESCAPE
+	"␀", "␛␀",
+	"␛", "␛␛",
+)
+
+func escapeName(name string, extension *string) string {
+	filename := name
+	if extension != nil {
+		filename = fmt.Sprintf("%s.%s", name, *extension)
+	}
+	filename = nameReplacer.Replace(NormalizeName(filename))
+	switch filename {
+	case "", ".":
+		// Not valid as names, so use FULLWIDTH FULL STOP instead
+		return "．"
+	case "..":
+		return "．．"
+	case "．", "．．":
+		// Really called that
+		return "␛" + filename
+	}
+	return filename
+}
+
+// The escaped sequences come first, since they take precedence
+var nameUnreplacer = strings.NewReplacer(
+	"␛∕", "∕",
+	"␛␀", "␀",
+	"␛␛", "␛",
+	"␛．", "．",
+	"∕", "/",
+	"␀", "\x00",
+)
+
+// The reverse of escapeName, giving the name to store in iCloud for an entry name.
+// Names with a suffix like " (2)" are kept as they are, since the suffix is only added to names that are listed, and this is used for the ones that aren't.
+func unescapeName(filename string) string {
+	switch filename {
+	case "．":
+		return "."
+	case "．．":
+		return ".."
+	}
+	return nameUnreplacer.Replace(filename)
+}
+
+// Returns name in the canonical form (NFC) that we use when comparing and presenting names
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
@@ -0,0 +1,151 @@
+package icloud
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindChild(t *testing.T) {
+	children := []*Node{
+		// Created on macOS, so stored as NFD
+		{Name: "Cafe\u0301", Extension: stringPtr("txt")},
+		{Name: "README", Extension: stringPtr("md")},
+		{Name: "notes", Extension: stringPtr("txt")},
+		{Name: "Notes", Extension: stringPtr("txt")},
+	}
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		expected        string
+	}{
+		{"Caf\u00e9.txt", false, "Cafe\u0301.txt"},
+		{"Cafe\u0301.txt", false, "Cafe\u0301.txt"},
+		{"readme.md", false, ""},
+		{"readme.md", true, "README.md"},
+		{"CAF\u00c9.TXT", true, "Cafe\u0301.txt"},
+		{"Notes.txt", true, "Notes.txt"},
+		{"notes.txt", true, "notes.txt"},
+		{"missing.txt", true, ""},
+	}
+	for _, test := range tests {
+		child := FindChild(children, test.name, test.caseInsensitive)
+		found := ""
+		if child != nil {
+			found = child.Filename()
+		}
+		if found != test.expected {
+			t.Errorf("FindChild(%q, %v) = %q, expected %q", test.name, test.caseInsensitive, found, test.expected)
+		}
+	}
+}
+
+func TestEntryNames(t *testing.T) {
+	older := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	children := []*Node{
+		{drivewsid: "FILE::b", Name: "report", Extension: stringPtr("pdf"), DateCreated: newer},
+		{drivewsid: "FILE::a", Name: "report", Extension: stringPtr("pdf"), DateCreated: older},
+		{drivewsid: "FILE::c", Name: "report (2)", Extension: stringPtr("pdf"), DateCreated: older},
+		{drivewsid: "FILE::d", Name: "AC/DC", Extension: stringPtr("mp3")},
+		{drivewsid: "FOLDER::e", Name: ".."},
+	}
+	expected := []string{"report (3).pdf", "report.pdf", "report (2).pdf", "AC∕DC.mp3", "．．"}
+	names := EntryNames(children)
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Incorrect names: %q, expected: %q", names, expected)
+	}
+
+	// The disambiguated names should resolve back to the right item
+	if child := FindChild(children, "report (3).pdf", false); child != children[0] {
+		t.Errorf("report (3).pdf resolved to: %v", child)
+	}
+	if child := FindChild(children, "AC∕DC.mp3", false); child != children[3] {
+		t.Errorf("AC∕DC.mp3 resolved to: %v", child)
+	}
+}
+
+func TestSplitFilename(t *testing.T) {
+	tests := []struct {
+		filename  string
+		name      string
+		extension *string
+	}{
+		{"notes.txt", "notes", stringPtr("txt")},
+		{"archive.tar.gz", "archive.tar", stringPtr("gz")},
+		{"Makefile", "Makefile", nil},
+		{".env", ".env", nil},
+		{"trailing.", "trailing.", nil},
+	}
+	for _, test := range tests {
+		name, extension := SplitFilename(test.filename)
+		node := &Node{Name: name, Extension: extension}
+		if name != test.name || !reflect.DeepEqual(extension, test.extension) || node.Filename() != test.filename {
+			t.Errorf("Incorrect split of %v: %v, %v", test.filename, name, extension)
+		}
+	}
+}
+
+func TestUnescapeName(t *testing.T) {
+	tests := []struct {
+		name      string
+		extension *string
+	}{
+		{"AC/DC", stringPtr("mp3")},
+		{"null\x00byte", nil},
+		{".", nil},
+		{"..", nil},
+		{"report (2)", stringPtr("pdf")},
+		// The replacements themselves
+		{"AC∕DC", stringPtr("mp3")},
+		{"null␀byte", nil},
+		{"slash/∕", nil},
+		{"escape␛∕", nil},
+		{"．", nil},
+		{"．．", nil},
+	}
+	for _, test := range tests {
+		escaped := escapeName(test.name, test.extension)
+		if strings.ContainsAny(escaped, "/\x00") {
+			t.Errorf("%q wasn't escaped: %q", test.name, escaped)
+		}
+		name, extension := SplitFilename(escaped)
+		if name != test.name || !reflect.DeepEqual(extension, test.extension) {
+			t.Errorf("%q was unescaped to: %q, %v", escaped, name, extension)
+		}
+	}
+}
+
+func TestFreeName(t *testing.T) {
+	children := []*Node{
+		{drivewsid: "FILE::a", Name: "notes (conflict from host)", Extension: stringPtr("txt")},
+		{drivewsid: "FILE::b", Name: "Notes (conflict from host) (2)", Extension: stringPtr("txt")},
+		{drivewsid: "FILE::c", Name: "other", Extension: stringPtr("txt")},
+	}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"notes", "notes"},
+		{"notes (conflict from host)", "notes (conflict from host) (3)"},
+		{"other", "other (2)"},
+	}
+	for _, test := range tests {
+		if name := FreeName(children, test.name, stringPtr("txt")); name != test.expected {
+			t.Errorf("FreeName(%q) = %q, expected %q", test.name, name, test.expected)
+		}
+	}
+}
+
+func TestNodeFindChildAfterRefresh(t *testing.T) {
+	dir := &Node{}
+	dir.setChildren([]*Node{{drivewsid: "FILE::a", Name: "a", Extension: stringPtr("txt")}})
+	if dir.FindChild("A.TXT", true) == nil {
+		t.Errorf("a.txt not found")
+	}
+	dir.setChildren([]*Node{{drivewsid: "FILE::b", Name: "b", Extension: stringPtr("txt")}})
+	if dir.FindChild("a.txt", false) != nil || dir.FindChild("b.txt", false) == nil {
+		t.Errorf("Names weren't updated with the children")
+	}
+}
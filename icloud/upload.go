@@ -0,0 +1,106 @@
+package icloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Called with the number of bytes sent so far, and the total number of bytes to send
+type ProgressFunc func(sent int64, total int64)
+
+// How many times an upload is attempted before giving up, and how long to wait before the first retry.
+// The delay is doubled for every retry.
+const maxUploadAttempts = 5
+
+var uploadRetryDelay = time.Second
+
+// Uploads the contents of reader, retrying if it fails in a way that might work if we try again.
+// iCloud doesn't let us continue a partial upload, so every attempt starts over with a new upload URL.
+func (drive *Drive) upload(node *Node, reader io.ReadSeeker, size int64, progress ProgressFunc) (*UploadFileData, error) {
+	delay := uploadRetryDelay
+	for attempt := 1; ; attempt++ {
+		fileData, retry, err := drive.uploadOnce(node, reader, size, progress)
+		if err == nil {
+			return fileData, nil
+		}
+		if !retry || attempt == maxUploadAttempts {
+			return nil, err
+		}
+		log.Printf("Upload of %v failed, retrying in %v: %v", node.Filename(), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Returns whether it's worth retrying if it fails
+func (drive *Drive) uploadOnce(node *Node, reader io.ReadSeeker, size int64, progress ProgressFunc) (*UploadFileData, bool, error) {
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	uploadData, err := drive.uploadFileData(node)
+	if err != nil {
+		return nil, true, err
+	}
+	body := &progressReader{reader: io.LimitReader(reader, size), total: size, progress: progress}
+	req, err := http.NewRequest("POST", uploadData.Url, body)
+	if err != nil {
+		return nil, false, err
+	}
+	// Lets the request be streamed with a known length, instead of chunked
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := drive.client.Do(req)
+	if body.err != nil {
+		// Reading what to upload failed, which won't get better by trying again
+		return nil, false, body.err
+	}
+	if err != nil {
+		// Most likely a network error
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, true, fmt.Errorf("Incorrect status code when uploading: %v, %v", resp.StatusCode, string(respBody))
+	} else if resp.StatusCode != 200 {
+		return nil, false, fmt.Errorf("Incorrect status code when uploading: %v, %v", resp.StatusCode, string(respBody))
+	}
+	response := new(UploadFileResponse)
+	err = json.Unmarshal(respBody, &response)
+	if err != nil {
+		return nil, false, err
+	}
+	return &response.SingleFile, false, nil
+}
+
+// Reports how much has been read through it
+type progressReader struct {
+	reader   io.Reader
+	sent     int64
+	total    int64
+	progress ProgressFunc
+	// Set if reading from reader failed, to tell that apart from failing to send it
+	err error
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	r.sent += int64(n)
+	if r.progress != nil && n > 0 {
+		r.progress(r.sent, r.total)
+	}
+	return n, err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Advisory locks (fcntl and flock) for a single file, these are only known to this host, so they don't protect against writes from anywhere else.
+// The zero value is an unlocked file.
+type lockTable struct {
+	sync.Mutex
+
+	locks []fileLock
+	// Closed and replaced whenever a lock is released, so that waiters can check again
+	changed chan struct{}
+}
+
+type fileLock struct {
+	owner uint64
+	// The handle the lock was taken through, so it can be released along with it
+	file *iCloudFile
+	fuse.FileLock
+}
+
+func overlaps(a, b *fuse.FileLock) bool {
+	return a.Start <= b.End && b.Start <= a.End
+}
+
+// Returns the first lock held by someone else that conflicts with lk, if any. Must be called with the lock held.
+func (table *lockTable) conflict(owner uint64, lk *fuse.FileLock) *fileLock {
+	for i := range table.locks {
+		held := &table.locks[i]
+		if held.owner != owner && overlaps(&held.FileLock, lk) && (held.Typ == syscall.F_WRLCK || lk.Typ == syscall.F_WRLCK) {
+			return held
+		}
+	}
+	return nil
+}
+
+func (table *lockTable) get(owner uint64, lk *fuse.FileLock, out *fuse.FileLock) {
+	table.Lock()
+	defer table.Unlock()
+	if held := table.conflict(owner, lk); held != nil {
+		*out = held.FileLock
+		return
+	}
+	*out = *lk
+	out.Typ = syscall.F_UNLCK
+}
+
+// Takes, changes or releases a lock, if wait is set it waits until it can be taken, otherwise EAGAIN is returned
+func (table *lockTable) set(ctx context.Context, file *iCloudFile, owner uint64, lk *fuse.FileLock, wait bool) syscall.Errno {
+	for {
+		table.Lock()
+		if lk.Typ == syscall.F_UNLCK || table.conflict(owner, lk) == nil {
+			table.unlock(owner, lk)
+			if lk.Typ != syscall.F_UNLCK {
+				table.locks = append(table.locks, fileLock{owner: owner, file: file, FileLock: *lk})
+			}
+			table.Unlock()
+			return 0
+		}
+		if !wait {
+			table.Unlock()
+			return syscall.EAGAIN
+		}
+		if table.changed == nil {
+			table.changed = make(chan struct{})
+		}
+		changed := table.changed
+		table.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+}
+
+// Releases the range in lk held by owner, splitting locks that are partly covered. Must be called with the lock held.
+func (table *lockTable) unlock(owner uint64, lk *fuse.FileLock) {
+	var remaining []fileLock
+	for _, held := range table.locks {
+		if held.owner != owner || !overlaps(&held.FileLock, lk) {
+			remaining = append(remaining, held)
+			continue
+		}
+		if held.Start < lk.Start {
+			before := held
+			before.End = lk.Start - 1
+			remaining = append(remaining, before)
+		}
+		if held.End > lk.End {
+			after := held
+			after.Start = lk.End + 1
+			remaining = append(remaining, after)
+		}
+	}
+	table.locks = remaining
+	table.notify()
+}
+
+// Releases all locks taken through file
+func (table *lockTable) releaseAll(file *iCloudFile) {
+	table.Lock()
+	defer table.Unlock()
+	var remaining []fileLock
+	for _, held := range table.locks {
+		if held.file != file {
+			remaining = append(remaining, held)
+		}
+	}
+	table.locks = remaining
+	table.notify()
+}
+
+// Must be called with the lock held
+func (table *lockTable) notify() {
+	if table.changed != nil {
+		close(table.changed)
+		table.changed = nil
+	}
+}
+
+var _ = (fs.FileGetlker)((*iCloudFile)(nil))
+var _ = (fs.FileSetlker)((*iCloudFile)(nil))
+var _ = (fs.FileSetlkwer)((*iCloudFile)(nil))
+
+func (file *iCloudFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	if file.inode.options.Locks == locksFail {
+		return syscall.ENOLCK
+	}
+	file.inode.locks.get(owner, lk, out)
+	return 0
+}
+
+func (file *iCloudFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if file.inode.options.Locks == locksFail {
+		return syscall.ENOLCK
+	}
+	return file.inode.locks.set(ctx, file, owner, lk, false)
+}
+
+func (file *iCloudFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if file.inode.options.Locks == locksFail {
+		return syscall.ENOLCK
+	}
+	return file.inode.locks.set(ctx, file, owner, lk, true)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"math"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestLockTable(t *testing.T) {
+	ctx := context.Background()
+	var table lockTable
+	first, second := &iCloudFile{}, &iCloudFile{}
+	whole := fuse.FileLock{Start: 0, End: math.MaxUint64, Typ: syscall.F_WRLCK}
+	read := fuse.FileLock{Start: 10, End: 19, Typ: syscall.F_RDLCK}
+
+	if errno := table.set(ctx, first, 1, &read, false); errno != 0 {
+		t.Fatal(errno)
+	}
+	// Read locks can be shared, but not combined with write locks
+	if errno := table.set(ctx, second, 2, &read, false); errno != 0 {
+		t.Error(errno)
+	}
+	if errno := table.set(ctx, second, 2, &whole, false); errno != syscall.EAGAIN {
+		t.Errorf("Expected EAGAIN, got: %v", errno)
+	}
+	var out fuse.FileLock
+	table.get(3, &whole, &out)
+	if out.Typ != syscall.F_RDLCK || out.Start != 10 {
+		t.Errorf("Incorrect conflicting lock: %v", out)
+	}
+
+	// Unlocking the middle leaves both ends locked
+	unlock := fuse.FileLock{Start: 12, End: 15, Typ: syscall.F_UNLCK}
+	table.set(ctx, first, 1, &unlock, false)
+	table.releaseAll(second)
+	table.get(3, &fuse.FileLock{Start: 12, End: 15, Typ: syscall.F_WRLCK}, &out)
+	if out.Typ != syscall.F_UNLCK {
+		t.Errorf("Range should be unlocked: %v", out)
+	}
+	table.get(3, &fuse.FileLock{Start: 16, End: 16, Typ: syscall.F_WRLCK}, &out)
+	if out.Typ != syscall.F_RDLCK || out.Start != 16 || out.End != 19 {
+		t.Errorf("Incorrect remaining lock: %v", out)
+	}
+
+	// Waiting is woken up when the lock is released
+	done := make(chan syscall.Errno)
+	go func() {
+		done <- table.set(ctx, second, 2, &whole, true)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	table.releaseAll(first)
+	select {
+	case errno := <-done:
+		if errno != 0 {
+			t.Error(errno)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiting for lock never finished")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if errno := table.set(cancelled, first, 1, &whole, true); errno != syscall.EINTR {
+		t.Errorf("Expected EINTR, got: %v", errno)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -20,12 +19,13 @@ import (
 const socketAddress = "/run/docker/plugins/icloud.sock"
 
 type iCloudVolume struct {
-	Path string
+	Path    string
+	Options map[string]string
 
 	Mountpoint  string
 	connections int
 	server      *fuse.Server
-	cancelFunc  func()
+	root        *iCloudInode
 }
 
 type iCloudDriver struct {
@@ -33,8 +33,11 @@ type iCloudDriver struct {
 
 	root      string
 	statePath string
-	drive     *icloud.Drive
-	volumes   map[string]*iCloudVolume
+	// Where metadata that can't be stored in iCloud is kept, one file per volume
+	metadataPath string
+	drive        *icloud.Drive
+	watcher      *changeWatcher
+	volumes      map[string]*iCloudVolume
 }
 
 func newIcloudDriver(statePath string) (*iCloudDriver, error) {
@@ -45,10 +48,13 @@ func newIcloudDriver(statePath string) (*iCloudDriver, error) {
 	}
 
 	d := &iCloudDriver{
-		root:      "/mnt/volumes",
-		statePath: filepath.Join(statePath, "state.json"),
-		drive:     drive,
-		volumes:   map[string]*iCloudVolume{},
+		root:         "/mnt/volumes",
+		statePath:    filepath.Join(statePath, "state.json"),
+		metadataPath: filepath.Join(statePath, "metadata"),
+		volumes:      map[string]*iCloudVolume{},
+	}
+	if drive != nil {
+		d.setDrive(drive)
 	}
 
 	if err := d.restoreState(); err != nil {
@@ -72,7 +78,14 @@ func (d *iCloudDriver) initiateInteractiveSession(sessionPath string) {
 	if err != nil {
 		panic("Handle this better")
 	}
+	d.Lock()
+	defer d.Unlock()
+	d.setDrive(drive)
+}
+
+func (d *iCloudDriver) setDrive(drive *icloud.Drive) {
 	d.drive = drive
+	d.watcher = newChangeWatcher(drive)
 }
 
 func (d *iCloudDriver) restoreState() error {
@@ -94,6 +107,10 @@ func (d *iCloudDriver) saveState() {
 	}
 }
 
+func (d *iCloudDriver) metadataFile(name string) string {
+	return filepath.Join(d.metadataPath, name+".json")
+}
+
 func (d *iCloudDriver) checkIfHasSession() error {
 	if d.drive == nil {
 		return fmt.Errorf("Session not configured. Telnet to :5000 to configure it")
@@ -116,7 +133,7 @@ func (d *iCloudDriver) Create(r *volume.CreateRequest) error {
 	d.Lock()
 	defer d.Unlock()
 
-	v := &iCloudVolume{Mountpoint: filepath.Join(d.root, r.Name)}
+	v := &iCloudVolume{Mountpoint: filepath.Join(d.root, r.Name), Options: r.Options}
 
 	for key, val := range r.Options {
 		switch key {
@@ -129,6 +146,10 @@ func (d *iCloudDriver) Create(r *volume.CreateRequest) error {
 		return logError("'path' is required")
 	}
 
+	if _, err := parseVolumeOptions(r.Options); err != nil {
+		return logError(err.Error())
+	}
+
 	d.volumes[r.Name] = v
 
 	d.saveState()
@@ -154,6 +175,9 @@ func (d *iCloudDriver) Remove(r *volume.RemoveRequest) error {
 	if err := os.RemoveAll(v.Mountpoint); err != nil {
 		return logError(err.Error())
 	}
+	if err := os.Remove(d.metadataFile(r.Name)); err != nil && !os.IsNotExist(err) {
+		return logError(err.Error())
+	}
 	delete(d.volumes, r.Name)
 
 	d.saveState()
@@ -222,42 +246,47 @@ func (d *iCloudDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, err
 			return &volume.MountResponse{}, logError("%v already exist and it's not a directory", v.Mountpoint)
 		}
 
-		node, err := d.drive.GetNode(v.Path)
+		options, err := parseVolumeOptions(v.Options)
+		if err != nil {
+			return nil, logError(err.Error())
+		}
+
+		root, err := d.drive.GetContainerRoot(options.Container)
+		if err != nil {
+			return nil, logError("Connecting to drive failed: %v\n", err)
+		}
+		node, err := d.drive.GetNodeIn(root, v.Path, options.CaseInsensitive)
 		if err != nil {
 			return nil, logError("Connecting to drive failed: %v\n", err)
 		}
-		inode := iCloudInode{
-			node:  node,
-			drive: *d.drive,
+		overlay, err := newMetadataOverlay(d.metadataFile(r.Name))
+		if err != nil {
+			return nil, logError("Reading metadata failed: %v", err)
 		}
+		inode := newRootInode(d.drive, node, &options, overlay)
 
 		timeout := time.Second * 10
 		opts := &fs.Options{
 			EntryTimeout: &timeout,
 			AttrTimeout:  &timeout,
+			// Makes the root keep its inode number across remounts, just like everything below it
+			RootStableAttr: &fs.StableAttr{Ino: inode.inodes.ino(node)},
 			MountOptions: fuse.MountOptions{
 				Debug: os.Getenv("DEBUG") != "",
+				// Locks are handled by iCloudFile, so that they can be made to fail, see the locks option
+				EnableLocks: true,
 			},
 		}
-		server, err := fs.Mount(v.Mountpoint, &inode, opts)
+		server, err := fs.Mount(v.Mountpoint, inode, opts)
 		if err != nil {
 			return nil, logError("Mounting failed: %v", err)
 		}
 		log.Printf("Serving: %v\n", server)
 		v.server = server
-		ctx, cancelFunc := context.WithCancel(context.Background())
-		v.cancelFunc = cancelFunc
-		go func(ctx context.Context) {
-			ticker := time.NewTicker(5 * time.Second)
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-ticker.C:
-					inode.ResetFileSystemCacheIfStale()
-				}
-			}
-		}(ctx)
+		v.root = inode
+		if options.PollInterval > 0 {
+			d.watcher.subscribe(v.root, options.PollInterval)
+		}
 	}
 
 	v.connections++
@@ -284,7 +313,7 @@ func (d *iCloudDriver) Unmount(r *volume.UnmountRequest) error {
 		if err := v.server.Unmount(); err != nil {
 			return logError(err.Error())
 		}
-		v.cancelFunc()
+		d.watcher.unsubscribe(v.root)
 		v.connections = 0
 	}
 	return nil
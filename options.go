@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+)
+
+// Options that can be passed when creating a volume, e.g. `-o uid=1000 -o dir_mode=0750`
+type volumeOptions struct {
+	Uid      uint32
+	Gid      uint32
+	FileMode uint32
+	DirMode  uint32
+	Umask    uint32
+
+	// How often to check iCloud for remote changes, 0 disables polling
+	PollInterval time.Duration
+
+	// Which iCloud container the path is relative to, see icloud.GetContainerRoot
+	Container string
+
+	// How packages (e.g. Pages documents) are exposed, either packagesAsZip or packagesAsDirs
+	Packages string
+
+	// Match names case-insensitively when looking them up, like iCloud does
+	CaseInsensitive bool
+
+	// Emulate symlinks with files in a special format, see symlink.go
+	Symlinks bool
+
+	// Keep permissions and owners set with chmod and chown, instead of using the ones above for everything
+	Permissions bool
+
+	// What to do when writing to a file that has been modified remotely, either conflictCopy or conflictFail
+	Conflict string
+
+	// How advisory locks are handled, either locksLocal or locksFail
+	Locks string
+}
+
+const (
+	packagesAsZip  = "zip"
+	packagesAsDirs = "dir"
+)
+
+const (
+	// Locks work between everything using the volume on this host, but aren't seen by anyone else.
+	// fcntl locks are only released when the last descriptor of the file is closed, not when the process that took them closes one,
+	// since go-fuse doesn't tell us which lock owner a flush is for.
+	locksLocal = "local"
+	// Fail with ENOLCK, instead of pretending that files are locked
+	locksFail = "fail"
+)
+
+const (
+	// Save what we wrote as a copy next to the original
+	conflictCopy = "copy"
+	// Fail the write with ESTALE
+	conflictFail = "fail"
+)
+
+func defaultVolumeOptions() volumeOptions {
+	return volumeOptions{
+		FileMode:     0644,
+		DirMode:      0755,
+		PollInterval: 5 * time.Second,
+		Packages:     packagesAsZip,
+		Conflict:     conflictCopy,
+		Locks:        locksLocal,
+	}
+}
+
+func parseVolumeOptions(raw map[string]string) (volumeOptions, error) {
+	opts := defaultVolumeOptions()
+	var err error
+	for key, val := range raw {
+		switch key {
+		case "path":
+			// Handled by Create
+		case "uid":
+			opts.Uid, err = parseId(key, val)
+		case "gid":
+			opts.Gid, err = parseId(key, val)
+		case "file_mode":
+			opts.FileMode, err = parseMode(key, val)
+		case "dir_mode":
+			opts.DirMode, err = parseMode(key, val)
+		case "umask":
+			opts.Umask, err = parseMode(key, val)
+		case "poll_interval":
+			opts.PollInterval, err = parseDuration(key, val)
+		case "container", "zone":
+			opts.Container = val
+		case "packages":
+			if val != packagesAsZip && val != packagesAsDirs {
+				err = fmt.Errorf("'%s' must be either %s or %s, got: %s", key, packagesAsZip, packagesAsDirs, val)
+			}
+			opts.Packages = val
+		case "conflict":
+			if val != conflictCopy && val != conflictFail {
+				err = fmt.Errorf("'%s' must be either %s or %s, got: %s", key, conflictCopy, conflictFail, val)
+			}
+			opts.Conflict = val
+		case "locks":
+			if val != locksLocal && val != locksFail {
+				err = fmt.Errorf("'%s' must be either %s or %s, got: %s", key, locksLocal, locksFail, val)
+			}
+			opts.Locks = val
+		case "case_insensitive":
+			opts.CaseInsensitive, err = parseBool(key, val)
+		case "symlinks":
+			opts.Symlinks, err = parseBool(key, val)
+		case "permissions":
+			opts.Permissions, err = parseBool(key, val)
+		default:
+			err = fmt.Errorf("Unknown option '%s'", key)
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func parseId(key, val string) (uint32, error) {
+	id, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' must be a numeric id, got: %s", key, val)
+	}
+	return uint32(id), nil
+}
+
+func parseMode(key, val string) (uint32, error) {
+	mode, err := strconv.ParseUint(val, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("'%s' must be an octal mode like 0644, got: %s", key, val)
+	}
+	return uint32(mode), nil
+}
+
+func parseBool(key, val string) (bool, error) {
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("'%s' must be true or false, got: %s", key, val)
+	}
+	return b, nil
+}
+
+func parseDuration(key, val string) (time.Duration, error) {
+	duration, err := time.ParseDuration(val)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("'%s' must be a duration like 30s, got: %s", key, val)
+	}
+	return duration, nil
+}
+
+// Returns true if node should be exposed as a directory
+func (opts *volumeOptions) isDir(node *icloud.Node) bool {
+	return node.IsDir() || (node.Type == icloud.TypePackage && opts.Packages == packagesAsDirs)
+}
+
+// Permission bits for a node, with the umask applied
+func (opts *volumeOptions) modeFor(node *icloud.Node) uint32 {
+	if opts.isDir(node) {
+		return opts.DirMode &^ opts.Umask
+	}
+	return opts.FileMode &^ opts.Umask
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseVolumeOptions(t *testing.T) {
+	opts, err := parseVolumeOptions(map[string]string{
+		"path":     "/Documents",
+		"uid":      "1000",
+		"gid":      "999",
+		"dir_mode": "0750",
+		"umask":    "027",
+
+		"poll_interval": "1m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Uid != 1000 || opts.Gid != 999 {
+		t.Errorf("Incorrect owner: %v:%v", opts.Uid, opts.Gid)
+	}
+	if opts.DirMode != 0750 {
+		t.Errorf("Incorrect dir_mode: %o", opts.DirMode)
+	}
+	if opts.PollInterval != time.Minute {
+		t.Errorf("Incorrect poll_interval: %v", opts.PollInterval)
+	}
+	if opts.FileMode&^opts.Umask != 0640 {
+		t.Errorf("Umask not applied to default file_mode: %o", opts.FileMode&^opts.Umask)
+	}
+}
+
+func TestParseVolumeOptionsInvalid(t *testing.T) {
+	for _, raw := range []map[string]string{
+		{"uid": "node"},
+		{"file_mode": "rw-r--r--"},
+		{"dir_mode": "01777"},
+		{"poll_interval": "-5s"},
+	} {
+		if _, err := parseVolumeOptions(raw); err == nil {
+			t.Errorf("Expected error for %v", raw)
+		}
+	}
+}
+
+func TestParseVolumeOptionsUnknown(t *testing.T) {
+	_, err := parseVolumeOptions(map[string]string{"path": "/Documents", "file_mod": "0600"})
+	if err == nil || !strings.Contains(err.Error(), "file_mod") {
+		t.Errorf("Expected an error naming file_mod, got: %v", err)
+	}
+}
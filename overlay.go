@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+)
+
+// Metadata that iCloud can't store for us, like modification times set with touch, permissions and extended attributes.
+// It's kept per drivewsid, and saved to path, so that it survives remounts, unless path is empty.
+type metadataOverlay struct {
+	sync.Mutex
+
+	path    string
+	entries map[string]*overlayEntry
+}
+
+type overlayEntry struct {
+	// Mtime only applies to the version of the item it was set on, identified by its Etag, so it's dropped as soon as the item is modified
+	Etag  string     `json:"etag"`
+	Mtime *time.Time `json:"mtime,omitempty"`
+	// These are kept for as long as the item exists
+	overlayPermissions
+	// The user.* extended attributes
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Set with chmod and chown, nil means that the volume's default is used
+type overlayPermissions struct {
+	Mode *uint32 `json:"mode,omitempty"`
+	Uid  *uint32 `json:"uid,omitempty"`
+	Gid  *uint32 `json:"gid,omitempty"`
+}
+
+func newMetadataOverlay(path string) (*metadataOverlay, error) {
+	overlay := &metadataOverlay{
+		path:    path,
+		entries: map[string]*overlayEntry{},
+	}
+	if path == "" {
+		return overlay, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return overlay, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &overlay.entries); err != nil {
+		return nil, err
+	}
+	return overlay, nil
+}
+
+// Returns the mtime set for this version of node, if any
+func (overlay *metadataOverlay) mtime(node *icloud.Node) (time.Time, bool) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	entry, ok := overlay.entries[node.Drivewsid()]
+	if !ok || entry.Mtime == nil || entry.Etag != node.Etag {
+		return time.Time{}, false
+	}
+	return *entry.Mtime, true
+}
+
+func (overlay *metadataOverlay) setMtime(node *icloud.Node, mtime time.Time) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	entry := overlay.entry(node)
+	entry.Etag = node.Etag
+	entry.Mtime = &mtime
+	overlay.save()
+}
+
+func (overlay *metadataOverlay) permissions(node *icloud.Node) overlayPermissions {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if entry, ok := overlay.entries[node.Drivewsid()]; ok {
+		return entry.overlayPermissions
+	}
+	return overlayPermissions{}
+}
+
+// Only sets what's not nil in permissions
+func (overlay *metadataOverlay) setPermissions(node *icloud.Node, permissions overlayPermissions) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	entry := overlay.entry(node)
+	if permissions.Mode != nil {
+		entry.Mode = permissions.Mode
+	}
+	if permissions.Uid != nil {
+		entry.Uid = permissions.Uid
+	}
+	if permissions.Gid != nil {
+		entry.Gid = permissions.Gid
+	}
+	overlay.save()
+}
+
+// Returns the value of the extended attribute name, or nil if it isn't set
+func (overlay *metadataOverlay) xattr(node *icloud.Node, name string) []byte {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if entry, ok := overlay.entries[node.Drivewsid()]; ok {
+		return entry.Xattrs[name]
+	}
+	return nil
+}
+
+// Returns the names of all extended attributes set on node
+func (overlay *metadataOverlay) xattrNames(node *icloud.Node) []string {
+	overlay.Lock()
+	defer overlay.Unlock()
+	var names []string
+	if entry, ok := overlay.entries[node.Drivewsid()]; ok {
+		for name := range entry.Xattrs {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (overlay *metadataOverlay) setXattr(node *icloud.Node, name string, value []byte) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	entry := overlay.entry(node)
+	if entry.Xattrs == nil {
+		entry.Xattrs = map[string][]byte{}
+	}
+	// The caller might reuse the buffer
+	entry.Xattrs[name] = append([]byte{}, value...)
+	overlay.save()
+}
+
+func (overlay *metadataOverlay) removeXattr(node *icloud.Node, name string) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if entry, ok := overlay.entries[node.Drivewsid()]; ok {
+		delete(entry.Xattrs, name)
+		overlay.save()
+	}
+}
+
+// Returns the entry for node, creating it if needed. Must be called with the lock held.
+func (overlay *metadataOverlay) entry(node *icloud.Node) *overlayEntry {
+	entry, ok := overlay.entries[node.Drivewsid()]
+	if !ok {
+		entry = &overlayEntry{}
+		overlay.entries[node.Drivewsid()] = entry
+	}
+	if entry.Etag != node.Etag {
+		// The mtime was set on an older version, so it doesn't apply anymore
+		entry.Mtime = nil
+	}
+	return entry
+}
+
+// Must be called with the lock held
+func (overlay *metadataOverlay) save() {
+	if overlay.path == "" {
+		return
+	}
+	data, err := json.Marshal(overlay.entries)
+	if err != nil {
+		log.Printf("Error marshalling metadata: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(overlay.path), 0755); err != nil {
+		log.Printf("Error saving metadata: %v", err)
+		return
+	}
+	if err := os.WriteFile(overlay.path, data, 0644); err != nil {
+		log.Printf("Error saving metadata: %v", err)
+	}
+}
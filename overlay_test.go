@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+)
+
+func TestMetadataOverlay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata", "volume.json")
+	overlay, err := newMetadataOverlay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &icloud.Node{Name: "notes", Etag: "1"}
+	if _, ok := overlay.mtime(node); ok {
+		t.Errorf("Expected no mtime")
+	}
+	mtime := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	overlay.setMtime(node, mtime)
+
+	// Should survive a remount
+	overlay, err = newMetadataOverlay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, ok := overlay.mtime(node); !ok || !stored.Equal(mtime) {
+		t.Errorf("Incorrect mtime: %v", stored)
+	}
+
+	// Doesn't apply once the node has been modified, unlike extended attributes
+	overlay.setXattr(node, "user.tag", []byte("red"))
+	modified := &icloud.Node{Name: "notes", Etag: "2"}
+	if _, ok := overlay.mtime(modified); ok {
+		t.Errorf("Expected no mtime for modified node")
+	}
+	if string(overlay.xattr(modified, "user.tag")) != "red" {
+		t.Errorf("Extended attribute should be kept")
+	}
+	overlay.removeXattr(modified, "user.tag")
+	if len(overlay.xattrNames(modified)) != 0 {
+		t.Errorf("Extended attribute should be removed")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// The contents of a package (e.g. a Pages document), when exposed as a read-only directory tree.
+// iCloud serves packages as zip-archives, so we download the whole thing to a temporary file, and serve it from there.
+type packageContents struct {
+	// The Etag of the package this was downloaded from, used to tell if it's stale
+	etag    string
+	archive io.ReaderAt
+	files   map[string]*zip.File
+	dirs    map[string]bool
+
+	// Guards extracted
+	sync.Mutex
+	// Compressed files, extracted to unlinked temporary files the first time they're read
+	extracted map[string]*os.File
+}
+
+func newPackageContents(etag string, archive io.ReaderAt, size int64) (*packageContents, error) {
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return nil, err
+	}
+	pkg := &packageContents{
+		etag:      etag,
+		archive:   archive,
+		files:     map[string]*zip.File{},
+		dirs:      map[string]bool{"": true},
+		extracted: map[string]*os.File{},
+	}
+	prefix := commonTopLevelDir(reader.File)
+	for _, file := range reader.File {
+		name := strings.Trim(strings.TrimPrefix(file.Name, prefix), "/")
+		if name == "" {
+			continue
+		}
+		if file.FileInfo().IsDir() {
+			pkg.dirs[name] = true
+		} else {
+			pkg.files[name] = file
+		}
+		// Not all archives have entries for the directories, so add all parents as well
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			pkg.dirs[dir] = true
+		}
+	}
+	return pkg, nil
+}
+
+// Returns a reader for the contents of the file at name. Files that are stored without compression are read directly from the archive.
+func (pkg *packageContents) reader(name string) (io.ReaderAt, error) {
+	file := pkg.files[name]
+	if file.Method == zip.Store {
+		offset, err := file.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(pkg.archive, offset, int64(file.UncompressedSize64)), nil
+	}
+
+	pkg.Lock()
+	defer pkg.Unlock()
+	if extracted, ok := pkg.extracted[name]; ok {
+		return extracted, nil
+	}
+	extracted, err := os.CreateTemp("", "icloud-package-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(extracted.Name())
+	reader, err := file.Open()
+	if err != nil {
+		extracted.Close()
+		return nil, err
+	}
+	defer reader.Close()
+	if _, err := io.Copy(extracted, reader); err != nil {
+		extracted.Close()
+		return nil, err
+	}
+	pkg.extracted[name] = extracted
+	return extracted, nil
+}
+
+// Archives are sometimes created with the package itself as the top-level directory, that's redundant since we're already in it
+func commonTopLevelDir(files []*zip.File) string {
+	var prefix string
+	for _, file := range files {
+		top, _, found := strings.Cut(file.Name, "/")
+		if !found || (prefix != "" && prefix != top+"/") {
+			return ""
+		}
+		prefix = top + "/"
+	}
+	return prefix
+}
+
+// Returns the names of the entries directly below dir, sorted
+func (pkg *packageContents) list(dir string) []string {
+	var names []string
+	for name := range pkg.dirs {
+		if name != "" && path.Dir(name) == orDot(dir) {
+			names = append(names, path.Base(name))
+		}
+	}
+	for name := range pkg.files {
+		if path.Dir(name) == orDot(dir) {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func orDot(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+// Looks up name in dir, and creates an inode for it. owner is the inode of the package itself.
+func (pkg *packageContents) lookup(ctx context.Context, parent *fs.Inode, owner *iCloudInode, dir string, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	entryPath := path.Join(dir, name)
+	id := owner.getNode().Drivewsid() + "/" + entryPath
+	ino := owner.inodes.allocate(id, hashString(entryPath))
+	var inode *fs.Inode
+	if pkg.dirs[entryPath] {
+		child := &packageDir{owner: owner, path: entryPath}
+		child.setAttr(&out.Attr)
+		inode = parent.NewInode(ctx, child, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: ino})
+	} else if file, ok := pkg.files[entryPath]; ok {
+		child := &packageFile{owner: owner, path: entryPath}
+		setPackageFileAttr(owner.options, file, &out.Attr)
+		inode = parent.NewInode(ctx, child, fs.StableAttr{Mode: fuse.S_IFREG, Ino: ino})
+	} else {
+		return nil, syscall.ENOENT
+	}
+	owner.inodes.register(id, inode)
+	return inode, 0
+}
+
+func (pkg *packageContents) readdir(owner *iCloudInode, dir string) fs.DirStream {
+	var entries []fuse.DirEntry
+	for _, name := range pkg.list(dir) {
+		entryPath := path.Join(dir, name)
+		entry := fuse.DirEntry{
+			Name: name,
+			Ino:  owner.inodes.peek(owner.getNode().Drivewsid()+"/"+entryPath, hashString(entryPath)),
+			Mode: fuse.S_IFREG,
+		}
+		if pkg.dirs[entryPath] {
+			entry.Mode = fuse.S_IFDIR
+		}
+		entries = append(entries, entry)
+	}
+	return fs.NewListDirStream(entries)
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// Downloads the package if it hasn't been done already, or if it has changed since
+func (inode *iCloudInode) getPackageContents() (*packageContents, syscall.Errno) {
+	inode.packageLock.Lock()
+	defer inode.packageLock.Unlock()
+	node := inode.getNode()
+	if inode.packageContents == nil || inode.packageContents.etag != node.Etag {
+		// Packages can be large, so keep them in an unlinked temporary file rather than in memory.
+		// The previous one is closed by the garbage collector, once nothing reads from it anymore.
+		archive, err := os.CreateTemp("", "icloud-package-")
+		if err != nil {
+			log.Println("Error when creating temporary file:", err)
+			return nil, syscall.EIO
+		}
+		os.Remove(archive.Name())
+		if err := inode.drive.GetDataTo(node, archive); err != nil {
+			archive.Close()
+			log.Println("Error when downloading package:", err)
+			return nil, syscall.EIO
+		}
+		size, err := archive.Seek(0, io.SeekCurrent)
+		if err != nil {
+			archive.Close()
+			log.Println("Error when downloading package:", err)
+			return nil, syscall.EIO
+		}
+		pkg, err := newPackageContents(node.Etag, archive, size)
+		if err != nil {
+			archive.Close()
+			log.Println("Error when reading package:", err)
+			return nil, syscall.EIO
+		}
+		inode.packageContents = pkg
+	}
+	return inode.packageContents, 0
+}
+
+// Notifies the kernel about everything in the package, if it has changed since it was downloaded
+func (inode *iCloudInode) invalidatePackage() {
+	inode.packageLock.Lock()
+	stale := inode.packageContents != nil && inode.packageContents.etag != inode.getNode().Etag
+	inode.packageLock.Unlock()
+	if stale {
+		notifyTree(&inode.Inode)
+	}
+}
+
+func notifyTree(dir *fs.Inode) {
+	for name, child := range dir.Children() {
+		if child.IsDir() {
+			notifyTree(child)
+		}
+		child.NotifyContent(0, 0)
+		dir.NotifyEntry(name)
+	}
+}
+
+func (inode *iCloudInode) hasPackageContents() bool {
+	inode.packageLock.Lock()
+	defer inode.packageLock.Unlock()
+	return inode.packageContents != nil
+}
+
+func (inode *iCloudInode) isPackageDir() bool {
+	node := inode.getNode()
+	return !node.IsDir() && inode.options.isDir(node)
+}
+
+// A directory inside a package. Like everything inside packages, it only knows its path, and looks it up in the package contents on access, since they're replaced when the package changes.
+type packageDir struct {
+	fs.Inode
+
+	owner *iCloudInode
+	path  string
+}
+
+var _ = (fs.NodeLookuper)((*packageDir)(nil))
+var _ = (fs.NodeReaddirer)((*packageDir)(nil))
+var _ = (fs.NodeGetattrer)((*packageDir)(nil))
+
+func (dir *packageDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	pkg, errno := dir.owner.getPackageContents()
+	if errno != 0 {
+		return nil, errno
+	}
+	return pkg.lookup(ctx, &dir.Inode, dir.owner, dir.path, name, out)
+}
+
+func (dir *packageDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	pkg, errno := dir.owner.getPackageContents()
+	if errno != 0 {
+		return nil, errno
+	}
+	if !pkg.dirs[dir.path] {
+		return nil, syscall.ENOENT
+	}
+	return pkg.readdir(dir.owner, dir.path), 0
+}
+
+func (dir *packageDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	dir.setAttr(&out.Attr)
+	return 0
+}
+
+func (dir *packageDir) setAttr(out *fuse.Attr) {
+	node := dir.owner.getNode()
+	options := dir.owner.options
+	out.Mode = options.DirMode &^ options.Umask
+	out.Owner = fuse.Owner{Uid: options.Uid, Gid: options.Gid}
+	out.SetTimes(nil, &node.DateChanged, nil)
+}
+
+// A file inside a package, these are read-only, since we can't upload a package partially
+type packageFile struct {
+	fs.Inode
+
+	owner *iCloudInode
+	path  string
+}
+
+var _ = (fs.NodeOpener)((*packageFile)(nil))
+var _ = (fs.NodeReader)((*packageFile)(nil))
+var _ = (fs.NodeGetattrer)((*packageFile)(nil))
+
+func (file *packageFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (file *packageFile) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	pkg, errno := file.owner.getPackageContents()
+	if errno != 0 {
+		return nil, errno
+	}
+	if _, ok := pkg.files[file.path]; !ok {
+		// Removed from the package since it was looked up
+		return nil, syscall.ENOENT
+	}
+	reader, err := pkg.reader(file.path)
+	if err != nil {
+		log.Println("Error when reading from package:", err)
+		return nil, syscall.EIO
+	}
+	n, err := reader.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		log.Println("Error when reading from package:", err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (file *packageFile) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	pkg, errno := file.owner.getPackageContents()
+	if errno != 0 {
+		return errno
+	}
+	zipFile, ok := pkg.files[file.path]
+	if !ok {
+		return syscall.ENOENT
+	}
+	setPackageFileAttr(file.owner.options, zipFile, &out.Attr)
+	return 0
+}
+
+func setPackageFileAttr(options *volumeOptions, file *zip.File, out *fuse.Attr) {
+	modified := file.Modified
+	out.Mode = options.FileMode &^ options.Umask
+	out.Owner = fuse.Owner{Uid: options.Uid, Gid: options.Gid}
+	out.Size = file.UncompressedSize64
+	out.SetTimes(nil, &modified, nil)
+}
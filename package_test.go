@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+	"github.com/cheif/docker-volume-icloud/icloud/icloudtest"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestPackageContents(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	for _, name := range []string{"Letter.pages/Index/Document.iwa", "Letter.pages/Metadata/", "Letter.pages/preview.jpg"} {
+		if _, err := writer.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, err := newPackageContents("etag", bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := pkg.list(""); !reflect.DeepEqual(root, []string{"Index", "Metadata", "preview.jpg"}) {
+		t.Errorf("Incorrect root listing: %v", root)
+	}
+	if index := pkg.list("Index"); !reflect.DeepEqual(index, []string{"Document.iwa"}) {
+		t.Errorf("Incorrect Index listing: %v", index)
+	}
+	if _, ok := pkg.files["Index/Document.iwa"]; !ok {
+		t.Errorf("Missing file: Index/Document.iwa")
+	}
+}
+
+func TestPackageFileContents(t *testing.T) {
+	data := zipArchive(t, map[string]string{"Index/Document.iwa": "compressed", "preview.jpg": "stored"})
+	pkg, err := newPackageContents("etag", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"Index/Document.iwa": "compressed", "preview.jpg": "stored"} {
+		reader, err := pkg.reader(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(io.NewSectionReader(reader, 0, int64(len(expected))+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Errorf("Incorrect contents of %v: %q", name, contents)
+		}
+	}
+}
+
+func TestPackageChildrenFollowChanges(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::letter", Docwsid: "letter", Name: "Letter", Extension: stringPtr("pages"), Type: icloud.TypePackage, Etag: "1"},
+		},
+	}
+	server := icloudtest.NewServer(t, folders)
+	server.Contents["letter"] = zipArchive(t, map[string]string{"preview.jpg": "before"})
+	options := defaultVolumeOptions()
+	options.Packages = packagesAsDirs
+	root := newFakeRoot(t, server.Drive(), &options)
+	ctx := context.Background()
+	var out fuse.EntryOut
+	letter, errno := root.Lookup(ctx, "Letter.pages", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	letterInode := letter.Operations().(*iCloudInode)
+	preview, errno := letterInode.Lookup(ctx, "preview.jpg", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	file := preview.Operations().(*packageFile)
+	read := func() string {
+		result, errno := file.Read(ctx, nil, make([]byte, 16), 0)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		data, _ := result.Bytes(nil)
+		return string(data)
+	}
+	if contents := read(); contents != "before" {
+		t.Errorf("Incorrect contents: %q", contents)
+	}
+
+	server.Lock()
+	folders["FOLDER::com.apple.CloudDocs::root"][0].Etag = "2"
+	server.Contents["letter"] = zipArchive(t, map[string]string{"preview.jpg": "after!"})
+	server.Unlock()
+	// Like the parent does when it's invalidated
+	node, errno := root.refreshAndFind("Letter.pages")
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	letterInode.setNode(node)
+
+	if contents := read(); contents != "after!" {
+		t.Errorf("Stale contents: %q", contents)
+	}
+	var attr fuse.AttrOut
+	if errno := file.Getattr(ctx, nil, &attr); errno != 0 || attr.Size != 6 {
+		t.Errorf("Stale size: %v, %v", attr.Size, errno)
+	}
+
+	server.Lock()
+	folders["FOLDER::com.apple.CloudDocs::root"][0].Etag = "3"
+	server.Contents["letter"] = zipArchive(t, map[string]string{"other.jpg": ""})
+	server.Unlock()
+	node, _ = root.refreshAndFind("Letter.pages")
+	letterInode.setNode(node)
+	if _, errno := file.Read(ctx, nil, make([]byte, 16), 0); errno != syscall.ENOENT {
+		t.Errorf("Expected ENOENT for a removed file, got: %v", errno)
+	}
+}
+
+func TestPackagesAsZipNames(t *testing.T) {
+	folders := map[string][]icloud.NodeDataItem{
+		"FOLDER::com.apple.CloudDocs::root": {
+			{Drivewsid: "FILE::com.apple.CloudDocs::letter", Docwsid: "letter", Name: "Letter", Extension: stringPtr("pages"), Type: icloud.TypePackage, Etag: "1"},
+			{Drivewsid: "FILE::com.apple.CloudDocs::notes", Docwsid: "notes", Name: "notes", Extension: stringPtr("txt"), Type: icloud.TypeFile, Etag: "1"},
+		},
+	}
+	options := defaultVolumeOptions()
+	options.CaseInsensitive = true
+	root := newFakeRoot(t, icloudtest.NewDrive(t, folders), &options)
+	dir := root.getNode()
+	children, names := root.entryNames(dir)
+	if !reflect.DeepEqual(names, []string{"Letter.pages.zip", "notes.txt"}) {
+		t.Errorf("Incorrect names: %v", names)
+	}
+	for _, name := range []string{"Letter.pages.zip", "letter.pages.ZIP"} {
+		if root.findChild(dir, name) != children[0] {
+			t.Errorf("Package not found by: %v", name)
+		}
+	}
+	if root.findChild(dir, "Letter.pages") != nil {
+		t.Errorf("Package found without the zip suffix")
+	}
+	if _, cached := dir.EntryNames(); cached[0] != "Letter.pages" {
+		t.Errorf("Cached names were modified: %v", cached)
+	}
+
+	options.Packages = packagesAsDirs
+	if _, names := root.entryNames(dir); names[0] != "Letter.pages" {
+		t.Errorf("Incorrect name for package as directory: %v", names[0])
+	}
+	if root.findChild(dir, "Letter.pages") != children[0] {
+		t.Errorf("Package not found by its name")
+	}
+}
+
+// Returns a zip-archive with files, stored without compression if their names end with .jpg
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	for name, contents := range files {
+		method := zip.Deflate
+		if path.Ext(name) == ".jpg" {
+			method = zip.Store
+		}
+		w, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(contents))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// iCloud doesn't have symlinks, so when enabled they're stored as regular files in the format used by
+// "Minshall+French" symlinks (e.g. the mfsymlinks option for CIFS), which is recognizable and has a fixed size:
+//
+//	XSym
+//	<length of target, 4 digits>
+//	<md5 of target>
+//	<target>
+//	<padded with spaces>
+const (
+	symlinkFileSize  = 1067
+	symlinkMaxTarget = 1024
+	symlinkHeader    = "XSym\n"
+	// Where the target starts, after the header, length and md5
+	symlinkTargetOffset = 43
+)
+
+func formatSymlink(target string) ([]byte, error) {
+	if len(target) == 0 || len(target) > symlinkMaxTarget {
+		return nil, fmt.Errorf("Symlink target must be between 1 and %d bytes, got: %d", symlinkMaxTarget, len(target))
+	}
+	data := []byte(fmt.Sprintf("%s%04d\n%x\n%s", symlinkHeader, len(target), md5.Sum([]byte(target)), target))
+	if len(data) < symlinkFileSize {
+		data = append(data, '\n')
+	}
+	return append(data, bytes.Repeat([]byte(" "), symlinkFileSize-len(data))...), nil
+}
+
+// Returns the target, and false if data isn't a symlink
+func parseSymlink(data []byte) (string, bool) {
+	if len(data) != symlinkFileSize || !bytes.HasPrefix(data, []byte(symlinkHeader)) {
+		return "", false
+	}
+	length, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || length <= 0 || length > symlinkMaxTarget {
+		return "", false
+	}
+	target := data[symlinkTargetOffset : symlinkTargetOffset+length]
+	if string(data[10:42]) != fmt.Sprintf("%x", md5.Sum(target)) {
+		return "", false
+	}
+	return string(target), true
+}
+
+// Files have to be downloaded to tell if they're symlinks, so remember what we've seen, until they're modified
+type symlinkCache struct {
+	sync.Mutex
+
+	entries map[string]symlinkEntry
+}
+
+type symlinkEntry struct {
+	etag   string
+	target string
+	isLink bool
+}
+
+func newSymlinkCache() *symlinkCache {
+	return &symlinkCache{entries: map[string]symlinkEntry{}}
+}
+
+// Returns the target of node, and false if it isn't a symlink
+func (inode *iCloudInode) symlinkTarget(node *icloud.Node) (string, bool) {
+	if !inode.options.Symlinks || node.IsDir() || node.Size != symlinkFileSize {
+		return "", false
+	}
+	cache := inode.symlinks
+	cache.Lock()
+	entry, ok := cache.entries[node.Drivewsid()]
+	cache.Unlock()
+	if ok && entry.etag == node.Etag {
+		return entry.target, entry.isLink
+	}
+
+	data, err := inode.drive.GetData(node)
+	if err != nil {
+		log.Println("Error when checking for symlink:", err)
+		return "", false
+	}
+	entry = symlinkEntry{etag: node.Etag}
+	entry.target, entry.isLink = parseSymlink(data)
+	cache.Lock()
+	cache.entries[node.Drivewsid()] = entry
+	cache.Unlock()
+	return entry.target, entry.isLink
+}
+
+// Returns the type bits for node
+func (inode *iCloudInode) fileType(node *icloud.Node) uint32 {
+	if inode.options.isDir(node) {
+		return fuse.S_IFDIR
+	}
+	if _, isLink := inode.symlinkTarget(node); isLink {
+		return fuse.S_IFLNK
+	}
+	return fuse.S_IFREG
+}
+
+var _ = (fs.NodeSymlinker)((*iCloudInode)(nil))
+var _ = (fs.NodeReadlinker)((*iCloudInode)(nil))
+
+func (inode *iCloudInode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !inode.options.Symlinks {
+		// Same as other filesystems without symlinks, e.g. vfat
+		return nil, syscall.EPERM
+	}
+	if inode.isReadOnlyDir() {
+		return nil, syscall.EROFS
+	}
+	data, err := formatSymlink(target)
+	if err != nil {
+		return nil, syscall.ENAMETOOLONG
+	}
+	existing, errno := inode.refreshAndFind(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	if existing != nil {
+		return nil, syscall.EEXIST
+	}
+	base, extension := icloud.SplitFilename(name)
+	if err := inode.drive.CreateFile(inode.getNode(), base, extension, data); err != nil {
+		log.Println("Error when creating symlink:", err)
+		return nil, syscall.EIO
+	}
+	created, errno := inode.refreshAndFind(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	if created == nil {
+		log.Printf("Created %v, but it isn't listed", name)
+		return nil, syscall.EIO
+	}
+
+	inode.setAttr(created, &out.Attr)
+	child := inode.generateInode(ctx, created)
+	child.Operations().(*iCloudInode).setNode(created)
+	return child, 0
+}
+
+func (inode *iCloudInode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, isLink := inode.symlinkTarget(inode.getNode())
+	if !isLink {
+		return nil, syscall.EINVAL
+	}
+	return []byte(target), 0
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSymlinkFormat(t *testing.T) {
+	for _, target := range []string{"../lib/node_modules/typescript/bin/tsc", "/usr/bin/python3", strings.Repeat("a", symlinkMaxTarget)} {
+		data, err := formatSymlink(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != symlinkFileSize {
+			t.Errorf("Incorrect size: %v", len(data))
+		}
+		parsed, isLink := parseSymlink(data)
+		if !isLink || parsed != target {
+			t.Errorf("Incorrect target: %v, %v", parsed, isLink)
+		}
+	}
+
+	if _, err := formatSymlink(strings.Repeat("a", symlinkMaxTarget+1)); err == nil {
+		t.Errorf("Expected error for too long target")
+	}
+
+	data, _ := formatSymlink("target")
+	corrupt := bytes.Replace(data, []byte("target"), []byte("tarjet"), 1)
+	if _, isLink := parseSymlink(corrupt); isLink {
+		t.Errorf("Checksum should be verified")
+	}
+	if _, isLink := parseSymlink(append([]byte("XSym\n"), bytes.Repeat([]byte(" "), symlinkFileSize-5)...)); isLink {
+		t.Errorf("Expected regular file")
+	}
+}
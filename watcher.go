@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+)
+
+// Polls iCloud for changes once per account, and fans them out to all mounted volumes.
+// The account is polled at the shortest poll interval of the subscribed volumes.
+type changeWatcher struct {
+	sync.Mutex
+
+	drive       *icloud.Drive
+	subscribers map[*iCloudInode]time.Duration
+	interval    time.Duration
+	cancelFunc  func()
+}
+
+func newChangeWatcher(drive *icloud.Drive) *changeWatcher {
+	return &changeWatcher{
+		drive:       drive,
+		subscribers: map[*iCloudInode]time.Duration{},
+	}
+}
+
+func (w *changeWatcher) subscribe(root *iCloudInode, interval time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	w.subscribers[root] = interval
+	w.restartIfNeeded()
+}
+
+func (w *changeWatcher) unsubscribe(root *iCloudInode) {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.subscribers, root)
+	w.restartIfNeeded()
+}
+
+// Makes sure that we're polling at the shortest interval requested, or not at all if nobody is subscribed
+func (w *changeWatcher) restartIfNeeded() {
+	var interval time.Duration
+	for _, candidate := range w.subscribers {
+		if interval == 0 || candidate < interval {
+			interval = candidate
+		}
+	}
+	if interval == w.interval {
+		return
+	}
+	if w.cancelFunc != nil {
+		w.cancelFunc()
+		w.cancelFunc = nil
+	}
+	w.interval = interval
+	if interval > 0 {
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		w.cancelFunc = cancelFunc
+		go w.poll(ctx, interval)
+	}
+}
+
+func (w *changeWatcher) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.checkForChanges()
+		}
+	}
+}
+
+func (w *changeWatcher) checkForChanges() {
+	changes, err := w.drive.GetChanges()
+	if err != nil {
+		log.Println("Error when checking for changes:", err)
+		return
+	}
+	if changes.IsEmpty() {
+		return
+	}
+	w.Lock()
+	roots := make([]*iCloudInode, 0, len(w.subscribers))
+	for root := range w.subscribers {
+		roots = append(roots, root)
+	}
+	w.Unlock()
+	for _, root := range roots {
+		root.invalidateTree(changes)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Extended attributes under this prefix expose what iCloud knows about an item, and can't be modified
+const icloudXattrPrefix = "user.icloud."
+
+// Only user.* attributes can be set, since we can't enforce the rules for the other namespaces
+const userXattrPrefix = "user."
+
+var _ = (fs.NodeGetxattrer)((*iCloudInode)(nil))
+var _ = (fs.NodeSetxattrer)((*iCloudInode)(nil))
+var _ = (fs.NodeRemovexattrer)((*iCloudInode)(nil))
+var _ = (fs.NodeListxattrer)((*iCloudInode)(nil))
+
+// Returns the iCloud metadata exposed as extended attributes, by name
+func (inode *iCloudInode) icloudXattrs() map[string]string {
+	node := inode.getNode()
+	status := "remote"
+	if atomic.LoadInt32(&inode.downloads) > 0 || inode.hasPackageContents() {
+		status = "downloaded"
+	}
+	return map[string]string{
+		icloudXattrPrefix + "drivewsid":       node.Drivewsid(),
+		icloudXattrPrefix + "docwsid":         node.Docwsid(),
+		icloudXattrPrefix + "etag":            node.Etag,
+		icloudXattrPrefix + "zone":            node.Zone(),
+		icloudXattrPrefix + "date_created":    node.DateCreated.Format(time.RFC3339),
+		icloudXattrPrefix + "download_status": status,
+	}
+}
+
+func (inode *iCloudInode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	var value []byte
+	if strings.HasPrefix(attr, icloudXattrPrefix) {
+		metadata, ok := inode.icloudXattrs()[attr]
+		if !ok {
+			return 0, syscall.ENODATA
+		}
+		value = []byte(metadata)
+	} else {
+		value = inode.overlay.xattr(inode.getNode(), attr)
+		if value == nil {
+			return 0, syscall.ENODATA
+		}
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+func (inode *iCloudInode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if strings.HasPrefix(attr, icloudXattrPrefix) {
+		return syscall.EPERM
+	}
+	if !strings.HasPrefix(attr, userXattrPrefix) {
+		return syscall.ENOTSUP
+	}
+	node := inode.getNode()
+	exists := inode.overlay.xattr(node, attr) != nil
+	if flags&xattrCreate != 0 && exists {
+		return syscall.EEXIST
+	}
+	if flags&xattrReplace != 0 && !exists {
+		return syscall.ENODATA
+	}
+	inode.overlay.setXattr(node, attr, data)
+	return 0
+}
+
+// Flags for setxattr(2)
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+func (inode *iCloudInode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if strings.HasPrefix(attr, icloudXattrPrefix) {
+		return syscall.EPERM
+	}
+	node := inode.getNode()
+	if inode.overlay.xattr(node, attr) == nil {
+		return syscall.ENODATA
+	}
+	inode.overlay.removeXattr(node, attr)
+	return 0
+}
+
+func (inode *iCloudInode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var names []string
+	for name := range inode.icloudXattrs() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var list []byte
+	for _, name := range append(names, inode.overlay.xattrNames(inode.getNode())...) {
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), 0
+}
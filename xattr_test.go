@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cheif/docker-volume-icloud/icloud"
+)
+
+func TestXattrs(t *testing.T) {
+	ctx := context.Background()
+	options := defaultVolumeOptions()
+	overlay, _ := newMetadataOverlay("")
+	inode := newRootInode(nil, &icloud.Node{Name: "notes", Etag: "42"}, &options, overlay)
+
+	dest := make([]byte, 64)
+	n, errno := inode.Getxattr(ctx, "user.icloud.etag", dest)
+	if errno != 0 || string(dest[:n]) != "42" {
+		t.Errorf("Incorrect etag: %q, %v", dest[:n], errno)
+	}
+	if _, errno := inode.Getxattr(ctx, "user.icloud.etag", nil); errno != syscall.ERANGE {
+		t.Errorf("Expected ERANGE, got: %v", errno)
+	}
+	n, _ = inode.Getxattr(ctx, "user.icloud.download_status", dest)
+	if string(dest[:n]) != "remote" {
+		t.Errorf("Incorrect download status: %q", dest[:n])
+	}
+
+	if errno := inode.Setxattr(ctx, "user.icloud.etag", []byte("1"), 0); errno != syscall.EPERM {
+		t.Errorf("Expected EPERM, got: %v", errno)
+	}
+	if errno := inode.Setxattr(ctx, "trusted.tag", []byte("red"), 0); errno != syscall.ENOTSUP {
+		t.Errorf("Expected ENOTSUP, got: %v", errno)
+	}
+	if errno := inode.Setxattr(ctx, "user.tag", []byte("red"), xattrReplace); errno != syscall.ENODATA {
+		t.Errorf("Expected ENODATA, got: %v", errno)
+	}
+	if errno := inode.Setxattr(ctx, "user.tag", []byte("red"), xattrCreate); errno != 0 {
+		t.Error(errno)
+	}
+	if errno := inode.Setxattr(ctx, "user.tag", []byte("blue"), xattrCreate); errno != syscall.EEXIST {
+		t.Errorf("Expected EEXIST, got: %v", errno)
+	}
+	n, errno = inode.Getxattr(ctx, "user.tag", dest)
+	if errno != 0 || string(dest[:n]) != "red" {
+		t.Errorf("Incorrect value: %q, %v", dest[:n], errno)
+	}
+
+	list := make([]byte, 1024)
+	n, errno = inode.Listxattr(ctx, list)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	names := strings.Split(strings.TrimSuffix(string(list[:n]), "\x00"), "\x00")
+	if len(names) != 7 || names[len(names)-1] != "user.tag" {
+		t.Errorf("Incorrect names: %v", names)
+	}
+
+	if errno := inode.Removexattr(ctx, "user.tag"); errno != 0 {
+		t.Error(errno)
+	}
+	if _, errno := inode.Getxattr(ctx, "user.tag", dest); errno != syscall.ENODATA {
+		t.Errorf("Expected ENODATA, got: %v", errno)
+	}
+}